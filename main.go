@@ -1,226 +1,2188 @@
 package main
 
 import (
+	"bufio"
+	"compress/gzip"
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
 	"time"
+	"unicode"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cwtypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/aws/smithy-go"
+	"github.com/bananaumai/s3-cleanup-objects/pkg/cleanup"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
 )
 
 const optMaxKeys = "max-keys"
 const optQuiet = "quiet"
 const optTimeout = "timeout"
+const optDryRun = "dry-run"
+const optRegion = "region"
+const optProfile = "profile"
+const optEndpointURL = "endpoint-url"
+const optS3ForcePathStyle = "s3-force-path-style"
+const optOutput = "output"
+const optWorkers = "workers"
+const optMaxRetries = "max-retries"
+const optRateLimit = "rate-limit"
+const optOlderThan = "older-than"
+const optInclude = "include"
+const optExclude = "exclude"
+const optFailFast = "fail-fast"
+const optStdin = "stdin"
+const optProgressInterval = "progress-interval"
+const optBypassGovernance = "bypass-governance"
+const optMFA = "mfa"
+const optYes = "yes"
+const optLogFormat = "log-format"
+const optListOnly = "list-only"
+const optOutputFile = "output-file"
+const optFromManifest = "from-manifest"
+const optCheckpointFile = "checkpoint-file"
+const optKeepLatest = "keep-latest"
+const optKeepVersions = "keep-versions"
+const optCurrentOnly = "current-only"
+const optDenyList = "deny-list"
+const optRampPaging = "ramp-paging"
+const optCountFirst = "count-first"
+const optPrefix = "prefix"
+const optDelimiter = "delimiter"
+const optShardPrefixes = "shard-prefixes"
+const optTagFilter = "tag-filter"
+const optMetricsFile = "metrics-file"
+const optSampleRate = "sample-rate"
+const optAbortMultipart = "abort-multipart"
+const optSince = "since"
+const optContinueOnError = "continue-on-error"
+const optRoleARN = "role-arn"
+const optExternalID = "external-id"
+const optErrorManifest = "error-manifest"
+const optUntil = "until"
+const optDeleteBucket = "delete-bucket"
+const optMaxDeletes = "max-deletes"
+const optLogObjects = "log-objects"
+const optDebug = "debug"
+const optRequesterPays = "requester-pays"
+const optExpectedBucketOwner = "expected-bucket-owner"
+const optParallelBuckets = "parallel-buckets"
+const optSummaryFile = "summary-file"
+const optListBucketsMatching = "list-buckets-matching"
+const optAPITimeout = "api-timeout"
+const optBatchOperations = "batch-operations"
+const optRetryFailed = "retry-failed"
+const optCorrelationID = "correlation-id"
+const optAutoRegion = "auto-region"
+const optVersionsOnly = "versions-only"
+const optMarkersOnly = "markers-only"
+const optDiffManifest = "diff-manifest"
+const optHTTPTimeout = "http-timeout"
+const optMaxIdleConns = "max-idle-conns"
+const optMaxConnsPerHost = "max-conns-per-host"
+const optVerify = "verify"
+const optConfig = "config"
+const optCloudWatchNamespace = "cloudwatch-namespace"
+const optIgnoreNotFound = "ignore-not-found"
+const optStartAfter = "start-after"
+const optStartVersionId = "start-version-id"
+const optFailOnEmpty = "fail-on-empty"
+const optDisableSSL = "disable-ssl"
+const optMarkersLast = "markers-last"
+const optMaxRuntime = "max-runtime"
+const optStreamEvents = "stream-events"
+const optFilterCommand = "filter-command"
+const optConfirmOver = "confirm-over"
+const optWebIdentity = "web-identity"
+const optObjectPrefixStats = "object-prefix-stats"
+const optLogLevel = "log-level"
+const optOTel = "otel"
+const optInventorySource = "inventory-source"
+const optListRetention = "list-retention"
+const optDeleteBatchSize = "delete-batch-size"
+const optS3SignatureVersion = "s3-signature-version"
 
 const defaultMaxKeys = 1000
 const defaultQuiet = false
 const defaultTimeout = 0
+const defaultDryRun = false
+const defaultRegion = ""
+const defaultProfile = ""
+const defaultEndpointURL = ""
+const defaultS3ForcePathStyle = false
+const defaultOutput = outputText
+const defaultWorkers = 1
+const defaultMaxRetries = 5
+const defaultRateLimit = 0
+const defaultOlderThan = 0
+const defaultInclude = ""
+const defaultExclude = ""
+const defaultFailFast = false
+const defaultStdin = false
+const defaultProgressInterval = 0
+const defaultBypassGovernance = false
+const defaultMFA = ""
+const defaultYes = false
+const defaultLogFormat = logFormatText
+const defaultListOnly = false
+const defaultOutputFile = ""
+const defaultFromManifest = ""
+const defaultCheckpointFile = ""
+const defaultKeepLatest = false
+const defaultKeepVersions = 0
+const defaultCurrentOnly = false
+const defaultDenyList = ""
+const defaultRampPaging = false
+const defaultCountFirst = false
+const defaultPrefix = ""
+const defaultDelimiter = ""
+const defaultShardPrefixes = ""
+const defaultTagFilter = ""
+const defaultMetricsFile = ""
+const defaultSampleRate = 1.0
+const defaultAbortMultipart = false
+const defaultSince = ""
+const defaultContinueOnError = false
+const defaultRoleARN = ""
+const defaultExternalID = ""
+const defaultErrorManifest = ""
+const defaultUntil = ""
+const defaultDeleteBucket = false
+const defaultMaxDeletes = 0
+const defaultLogObjects = false
+const defaultDebug = false
+const defaultRequesterPays = false
+const defaultExpectedBucketOwner = ""
+const defaultParallelBuckets = 1
+const defaultSummaryFile = ""
+const defaultListBucketsMatching = ""
+const defaultAPITimeout = 0
+const defaultBatchOperations = false
+const defaultRetryFailed = ""
+const defaultCorrelationID = ""
+const defaultAutoRegion = false
+const defaultVersionsOnly = false
+const defaultMarkersOnly = false
+const defaultDiffManifest = ""
+const defaultHTTPTimeout = 0
+const defaultMaxIdleConns = 0
+const defaultMaxConnsPerHost = 0
+const defaultVerify = false
+const defaultConfig = ""
+const defaultCloudWatchNamespace = ""
+const defaultIgnoreNotFound = false
+const defaultStartAfter = ""
+const defaultStartVersionId = ""
+const defaultFailOnEmpty = 0
+const defaultDisableSSL = false
+const defaultMarkersLast = false
+const defaultMaxRuntime = 0
+const defaultStreamEvents = false
+const defaultFilterCommand = ""
+const defaultConfirmOver = 0
+const defaultWebIdentity = false
+const defaultObjectPrefixStats = false
+const defaultLogLevel = ""
+const defaultOTel = false
+const defaultInventorySource = ""
+const defaultListRetention = false
+const defaultDeleteBatchSize = 1000
+const defaultS3SignatureVersion = signatureV4
+
+// envCorrelationID is the environment variable -correlation-id defaults to.
+const envCorrelationID = "X_CORRELATION_ID"
+
+// envWebIdentityTokenFile, envRoleARN, and envRoleSessionName are the environment variables -web-identity reads,
+// as set for the pods by IAM Roles for Service Accounts on EKS.
+const envWebIdentityTokenFile = "AWS_WEB_IDENTITY_TOKEN_FILE"
+const envRoleARN = "AWS_ROLE_ARN"
+const envRoleSessionName = "AWS_ROLE_SESSION_NAME"
+
+// progressBarWidth is the number of characters of the -count-first progress bar.
+const progressBarWidth = 40
+
+// progressLogInterval is how often -count-first logs the percentage when stderr isn't a terminal and -progress-interval isn't set.
+const progressLogInterval = 10 * time.Second
+
+// cloudWatchTimeout bounds the publication of -cloudwatch-namespace metrics, which happens after -timeout may have expired.
+const cloudWatchTimeout = 30 * time.Second
+
+// otelServiceName is the service name of the -otel traces, unless OTEL_SERVICE_NAME or OTEL_RESOURCE_ATTRIBUTES set another one.
+const otelServiceName = "cleanup-s3-objects"
+
+// otelShutdownTimeout bounds the export of the remaining -otel spans at the end of the run.
+const otelShutdownTimeout = 10 * time.Second
+
+// maxMetricData is the maximum number of metrics a PutMetricData call takes.
+const maxMetricData = 1000
+
+// exit codes tell the failure modes apart for automation.
+const exitOK = 0
+const exitUsage = 1
+const exitConfig = 2
+const exitPartialFailure = 3
+const exitInterrupted = 4
+const exitError = 5
+const exitRemaining = 6
+
+const outputText = "text"
+const outputJSON = "json"
+
+// signatureV4 is the only signature version the SDK signs requests with; signatureV2 is named to reject it with the reason.
+const signatureV4 = "v4"
+const signatureV2 = "v2"
+
+const logFormatText = "text"
+const logFormatJSON = "json"
+
+const eventBatchDeleted = "batch_deleted"
+const eventTypeVersion = "version"
+const eventTypeDeleteMarker = "delete_marker"
+
+// bucketNamePattern matches the characters allowed in bucket names, which start and end with a letter or a digit.
+var bucketNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]*[a-z0-9]$`)
+
+// reservedBucketPrefixes and reservedBucketSuffixes are reserved by S3 for its own names, e.g., access point aliases, and can't name a bucket.
+var (
+	reservedBucketPrefixes = []string{"xn--", "sthree-"}
+	reservedBucketSuffixes = []string{"-s3alias", "--ol-s3"}
+)
+
+// accountIDPattern matches AWS account IDs, for -expected-bucket-owner.
+var accountIDPattern = regexp.MustCompile(`^[0-9]{12}$`)
+
+// errNotConfirmed is the error of a bucket over -confirm-over whose deletion isn't confirmed.
+var errNotConfirmed = errors.New("deletion not confirmed")
 
 func printUsage() {
 	cmd := os.Args[0]
-	_, _ = fmt.Fprintf(os.Stderr, "Usage: %s [-%s <n: 1-1000>] [-%s] [-%s <duration>] <bucket>\n", cmd, optMaxKeys, optQuiet, optTimeout)
+	_, _ = fmt.Fprintf(os.Stderr, "Usage: %s [options] <bucket>...\n\nOptions:\n", cmd)
 	flag.PrintDefaults()
 }
 
+// options are the values of the command-line flags, along with the ones validate parses out of them.
+type options struct {
+	maxKeys int64
+	quiet   bool
+	timeout time.Duration
+	dryRun  bool
+	region  string
+	profile string
+
+	roleARN     string
+	externalID  string
+	webIdentity bool
+
+	endpointURL      string
+	s3ForcePathStyle bool
+
+	output     string
+	workers    int
+	maxRetries int
+	rateLimit  float64
+	olderThan  time.Duration
+	include    string
+	exclude    string
+	failFast   bool
+	stdin      bool
+
+	progressInterval time.Duration
+	bypassGovernance bool
+	mfa              string
+	yes              bool
+	logFormat        string
+	listOnly         bool
+	outputFile       string
+	fromManifest     string
+	checkpointFile   string
+	keepLatest       bool
+	currentOnly      bool
+	keepVersions     int
+	denyListFile     string
+	rampPaging       bool
+	countFirst       bool
+	prefix           string
+	delimiter        string
+	shardPrefixes    string
+	tagFilter        string
+	metricsFile      string
+	sampleRate       float64
+	abortMultipart   bool
+	since            string
+	until            string
+
+	continueOnError   bool
+	errorManifestFile string
+	deleteBucket      bool
+	maxDeletes        int
+	logObjects        bool
+	debug             bool
+	requesterPays     bool
+	bucketOwner       string
+	parallelBuckets   int
+	summaryFile       string
+	bucketPattern     string
+	apiTimeout        time.Duration
+	batchOperations   bool
+	retryFailed       string
+	correlationID     string
+	autoRegion        bool
+	versionsOnly      bool
+	markersOnly       bool
+	diffManifest      string
+	httpTimeout       time.Duration
+	maxIdleConns      int
+	maxConnsPerHost   int
+	verify            bool
+	configFile        string
+	cwNamespace       string
+	ignoreNotFound    bool
+	startAfter        string
+	startVersionId    string
+	failOnEmpty       int
+	disableSSL        bool
+	markersLast       bool
+	maxRuntime        time.Duration
+	streamEvents      bool
+	filterCommand     string
+	confirmOver       int
+	prefixStats       bool
+	logLevel          string
+	otelEnabled       bool
+	inventorySource   string
+	listRetention     bool
+	deleteBatchSize   int
+	signatureVersion  string
+
+	// set by validate.
+	sinceTime, untilTime                       time.Time
+	includeRegexp, excludeRegexp, bucketRegexp *regexp.Regexp
+	shards                                     []string
+	parsedTagFilter                            *cleanup.TagFilter
+	level                                      slog.Level
+}
+
 func main() {
-	var (
-		maxKeys int64
-		quiet   bool
-		timeout time.Duration
-	)
+	var o options
 
-	flag.Int64Var(&maxKeys, optMaxKeys, defaultMaxKeys, "max-keys parameter for the S3 ListObjectVersions API")
-	flag.BoolVar(&quiet, optQuiet, defaultQuiet, "suppress logging messages")
-	flag.DurationVar(&timeout, optTimeout, defaultTimeout, "set timeout for the operation")
+	flag.Int64Var(&o.maxKeys, optMaxKeys, defaultMaxKeys, fmt.Sprintf("max-keys parameter for the S3 ListObjectVersions API, %d-%d", cleanup.MinMaxKeys, cleanup.MaxMaxKeys))
+	flag.BoolVar(&o.quiet, optQuiet, defaultQuiet, "suppress logging messages and the text summary; errors are still printed to stderr")
+	flag.DurationVar(&o.timeout, optTimeout, defaultTimeout, "set timeout for the operation")
+	flag.DurationVar(&o.maxRuntime, optMaxRuntime, defaultMaxRuntime, "stop gracefully after this duration, letting the in-flight deletions complete, and exit successfully (0 disables it)")
+	flag.DurationVar(&o.apiTimeout, optAPITimeout, defaultAPITimeout, "time out and retry each API call after this duration, e.g., 30s (0 disables it)")
+	flag.DurationVar(&o.httpTimeout, optHTTPTimeout, defaultHTTPTimeout, "time limit of the HTTP client for each request, response body included (0 disables it)")
+	flag.IntVar(&o.maxIdleConns, optMaxIdleConns, defaultMaxIdleConns, "maximum number of idle HTTP connections kept for reuse, in total and per host (0 keeps the SDK's defaults)")
+	flag.IntVar(&o.maxConnsPerHost, optMaxConnsPerHost, defaultMaxConnsPerHost, "maximum number of HTTP connections per host (0 for no limit)")
+	flag.BoolVar(&o.dryRun, optDryRun, defaultDryRun, "list versions and delete markers that would be deleted without deleting them")
+	flag.StringVar(&o.region, optRegion, defaultRegion, "AWS region of the bucket (defaults to the SDK's region resolution)")
+	flag.BoolVar(&o.autoRegion, optAutoRegion, defaultAutoRegion, "clean up the buckets in other regions than -"+optRegion+" with a client for their region instead of failing")
+	flag.StringVar(&o.profile, optProfile, defaultProfile, "named profile in the shared AWS config and credentials files")
+	flag.StringVar(&o.roleARN, optRoleARN, defaultRoleARN, "ARN of an IAM role to assume, e.g., to clean up buckets in another account")
+	flag.StringVar(&o.externalID, optExternalID, defaultExternalID, "external ID to pass when assuming -"+optRoleARN)
+	flag.BoolVar(&o.webIdentity, optWebIdentity, defaultWebIdentity, "get the credentials with the web identity token of "+envWebIdentityTokenFile+" for the role of "+envRoleARN+", e.g., with IRSA on EKS")
+	flag.StringVar(&o.endpointURL, optEndpointURL, defaultEndpointURL, "custom S3 endpoint URL (e.g., for LocalStack or MinIO)")
+	flag.BoolVar(&o.s3ForcePathStyle, optS3ForcePathStyle, defaultS3ForcePathStyle, "use path-style addressing for S3 requests")
+	flag.BoolVar(&o.disableSSL, optDisableSSL, defaultDisableSSL, "send the S3 requests over plain HTTP, e.g., for S3-compatible services without TLS")
+	flag.StringVar(&o.signatureVersion, optS3SignatureVersion, defaultS3SignatureVersion, "signature version of the S3 requests; only "+signatureV4+" is supported, as the AWS SDK for Go v2 has no SigV2 signer")
+	flag.StringVar(&o.output, optOutput, defaultOutput, "format of the final summary: text or json")
+	flag.BoolVar(&o.streamEvents, optStreamEvents, defaultStreamEvents, "write a JSON line to stdout after each deleted batch, e.g., for live dashboards; the summary then goes to stderr")
+	flag.IntVar(&o.workers, optWorkers, defaultWorkers, "number of DeleteObjects batches to run in parallel")
+	flag.IntVar(&o.deleteBatchSize, optDeleteBatchSize, defaultDeleteBatchSize, fmt.Sprintf("maximum number of keys of each DeleteObjects call, %d-%d", cleanup.MinDeleteBatchSize, cleanup.MaxDeleteBatchSize))
+	flag.IntVar(&o.maxRetries, optMaxRetries, defaultMaxRetries, "maximum number of retries for throttled or failed API calls")
+	flag.Float64Var(&o.rateLimit, optRateLimit, defaultRateLimit, "maximum number of DeleteObjects calls per second (0 means unlimited)")
+	flag.DurationVar(&o.olderThan, optOlderThan, defaultOlderThan, "only delete versions and delete markers last modified longer ago than this duration")
+	flag.StringVar(&o.include, optInclude, defaultInclude, "only delete objects whose key matches this regular expression")
+	flag.StringVar(&o.exclude, optExclude, defaultExclude, "never delete objects whose key matches this regular expression (takes precedence over -"+optInclude+")")
+	flag.BoolVar(&o.failFast, optFailFast, defaultFailFast, "stop processing the remaining buckets after the first failure")
+	flag.IntVar(&o.failOnEmpty, optFailOnEmpty, defaultFailOnEmpty, "exit with this code if a bucket has nothing to delete within the prefix and the filters, e.g., to catch mis-targeted runs (0 disables it)")
+	flag.StringVar(&o.bucketPattern, optListBucketsMatching, defaultListBucketsMatching, "also clean up all the buckets of the account whose names match this regular expression; requires -"+optYes)
+	flag.IntVar(&o.parallelBuckets, optParallelBuckets, defaultParallelBuckets, "number of buckets to clean up at once")
+	flag.BoolVar(&o.stdin, optStdin, defaultStdin, "read newline-delimited bucket names from standard input in addition to the arguments")
+	flag.DurationVar(&o.progressInterval, optProgressInterval, defaultProgressInterval, "log the cumulative number of deleted objects at this interval (0 disables it)")
+	flag.BoolVar(&o.bypassGovernance, optBypassGovernance, defaultBypassGovernance, "bypass Object Lock governance-mode retention (requires the s3:BypassGovernanceRetention permission)")
+	flag.StringVar(&o.mfa, optMFA, defaultMFA, "MFA device serial number and token code separated by a space, for buckets with MFA Delete enabled")
+	flag.BoolVar(&o.yes, optYes, defaultYes, "skip the confirmation prompt (required in non-interactive environments)")
+	flag.IntVar(&o.confirmOver, optConfirmOver, defaultConfirmOver, "only ask for confirmation for the buckets with more than this many versions and delete markers to delete, counted first (0 always asks)")
+	flag.StringVar(&o.logFormat, optLogFormat, defaultLogFormat, "format of the log messages: text or json")
+	flag.BoolVar(&o.otelEnabled, optOTel, defaultOTel, "trace the run with OpenTelemetry, exporting the spans with OTLP as configured by the OTEL_EXPORTER_OTLP_* environment variables")
+	flag.StringVar(&o.logLevel, optLogLevel, defaultLogLevel, "minimum level of the log messages: debug, info, warn, or error (defaults to info, debug with -"+optDebug+", and error with -"+optQuiet+")")
+	flag.StringVar(&o.correlationID, optCorrelationID, defaultCorrelationID, "ID added to every log message and to the JSON summaries, e.g., to tie them to the job that ran the command; defaults to $"+envCorrelationID)
+	flag.BoolVar(&o.listOnly, optListOnly, defaultListOnly, "write the versions and delete markers that would be deleted to -"+optOutputFile+" without deleting them")
+	flag.StringVar(&o.outputFile, optOutputFile, defaultOutputFile, "manifest file for -"+optListOnly+"; CSV if it ends with .csv, JSON lines otherwise")
+	flag.StringVar(&o.diffManifest, optDiffManifest, defaultDiffManifest, "with -"+optListOnly+", report the versions and delete markers added and removed since this earlier -"+optOutputFile+" manifest")
+	flag.BoolVar(&o.listRetention, optListRetention, defaultListRetention, "with -"+optListOnly+", record the Object Lock retention and legal hold of each version in -"+optOutputFile+", at the cost of two API calls per version")
+	flag.BoolVar(&o.batchOperations, optBatchOperations, defaultBatchOperations, "with -"+optListOnly+", write -"+optOutputFile+" as an S3 Batch Operations CSV manifest of buckets, keys, and version IDs")
+	flag.StringVar(&o.inventorySource, optInventorySource, defaultInventorySource, "delete the versions and delete markers listed in the S3 Inventory report whose manifest.json is at this s3:// URL or path instead of listing the buckets; CSV reports only, not ORC or Parquet")
+	flag.StringVar(&o.fromManifest, optFromManifest, defaultFromManifest, "delete the versions and delete markers listed in this manifest file instead of listing the buckets; CSV if it ends with .csv, JSON lines otherwise")
+	flag.StringVar(&o.checkpointFile, optCheckpointFile, defaultCheckpointFile, "record the listing position after each deleted page in this file and resume from it if it exists")
+	flag.BoolVar(&o.keepLatest, optKeepLatest, defaultKeepLatest, "keep the current version of each key and only delete the older versions and delete markers")
+	flag.BoolVar(&o.versionsOnly, optVersionsOnly, defaultVersionsOnly, "only delete versions and leave the delete markers alone")
+	flag.BoolVar(&o.markersOnly, optMarkersOnly, defaultMarkersOnly, "only delete delete markers, which undeletes the objects they hide, and leave the versions alone")
+	flag.BoolVar(&o.markersLast, optMarkersLast, defaultMarkersLast, "delete the delete markers only after all the versions are deleted, so no older version becomes current meanwhile")
+	flag.BoolVar(&o.currentOnly, optCurrentOnly, defaultCurrentOnly, "only hide the current version of each key behind a new delete marker, keeping the version history")
+	flag.IntVar(&o.keepVersions, optKeepVersions, defaultKeepVersions, "keep the newest N versions and delete markers of each key and delete the rest (0 disables it)")
+	flag.StringVar(&o.denyListFile, optDenyList, defaultDenyList, "file of newline-delimited keys and key prefixes that must never be deleted")
+	flag.BoolVar(&o.rampPaging, optRampPaging, defaultRampPaging, "start listing with a max-keys of 100 and double it on each page up to -"+optMaxKeys+", for faster first deletions")
+	flag.BoolVar(&o.countFirst, optCountFirst, defaultCountFirst, "count the versions and delete markers to delete first, then show the percentage deleted")
+	flag.StringVar(&o.prefix, optPrefix, defaultPrefix, "only list and delete keys starting with this prefix")
+	flag.StringVar(&o.delimiter, optDelimiter, defaultDelimiter, "only list and delete keys without this delimiter after -"+optPrefix+", e.g., / for a single directory level")
+	flag.StringVar(&o.startAfter, optStartAfter, defaultStartAfter, "start listing after this key, e.g., to split a bucket into key ranges across runs")
+	flag.StringVar(&o.startVersionId, optStartVersionId, defaultStartVersionId, "with -"+optStartAfter+", start listing after this version of its key rather than after all of its versions")
+	flag.StringVar(&o.shardPrefixes, optShardPrefixes, defaultShardPrefixes, "comma-separated prefixes, appended to -"+optPrefix+", to list concurrently, e.g., 0,1,2,3,4,5,6,7,8,9,a,b,c,d,e,f; keys outside them are kept")
+	flag.StringVar(&o.tagFilter, optTagFilter, defaultTagFilter, "only delete versions whose tags match key=value or key!=value; calls GetObjectTagging for each version")
+	flag.StringVar(&o.filterCommand, optFilterCommand, defaultFilterCommand, "shell command that reads each page of candidates as a JSON array on stdin and prints the array of the ones to delete")
+	flag.StringVar(&o.metricsFile, optMetricsFile, defaultMetricsFile, "write the API call counts and timings as JSON to this file")
+	flag.StringVar(&o.cwNamespace, optCloudWatchNamespace, defaultCloudWatchNamespace, "publish the deleted counts and bytes of each bucket as CloudWatch metrics in this namespace at the end of the run")
+	flag.StringVar(&o.summaryFile, optSummaryFile, defaultSummaryFile, "write the summary of the run, per bucket and in total, along with the metrics, as JSON to this file")
+	flag.Float64Var(&o.sampleRate, optSampleRate, defaultSampleRate, "delete each matching version and delete marker with this probability, greater than 0 and at most 1, for cautious trial runs")
+	flag.BoolVar(&o.abortMultipart, optAbortMultipart, defaultAbortMultipart, "also abort the incomplete multipart uploads of the buckets")
+	flag.StringVar(&o.since, optSince, defaultSince, "only delete versions and delete markers last modified at or after this RFC3339 time")
+	flag.StringVar(&o.until, optUntil, defaultUntil, "only delete versions and delete markers last modified before this RFC3339 time")
+	flag.BoolVar(&o.continueOnError, optContinueOnError, defaultContinueOnError, "keep going after a failed DeleteObjects batch and exit with a non-zero status at the end")
+	flag.BoolVar(&o.ignoreNotFound, optIgnoreNotFound, defaultIgnoreNotFound, "count the versions and delete markers already gone, e.g., deleted by a concurrent run, as deleted rather than failed")
+	flag.StringVar(&o.bucketOwner, optExpectedBucketOwner, defaultExpectedBucketOwner, "account ID the buckets must belong to; S3 rejects the requests otherwise")
+	flag.BoolVar(&o.requesterPays, optRequesterPays, defaultRequesterPays, "acknowledge the request charges of requester-pays buckets, which can't be cleaned up otherwise")
+	flag.BoolVar(&o.debug, optDebug, defaultDebug, "log debug messages and print the original S3 errors instead of the concise messages")
+	flag.BoolVar(&o.logObjects, optLogObjects, defaultLogObjects, "log each deleted version and delete marker with its key and version ID, e.g., for audit trails")
+	flag.BoolVar(&o.prefixStats, optObjectPrefixStats, defaultObjectPrefixStats, "break the deleted versions, delete markers, and bytes down by top-level prefix in the summary")
+	flag.IntVar(&o.maxDeletes, optMaxDeletes, defaultMaxDeletes, "stop once this many versions and delete markers have been deleted across all the buckets (0 disables it)")
+	flag.BoolVar(&o.verify, optVerify, defaultVerify, fmt.Sprintf("list each bucket again after the cleanup and exit with %d if versions or delete markers matching the filters remain", exitRemaining))
+	flag.BoolVar(&o.deleteBucket, optDeleteBucket, defaultDeleteBucket, "delete each bucket once it's empty after the cleanup; fails if any version or delete marker remains")
+	flag.StringVar(&o.errorManifestFile, optErrorManifest, defaultErrorManifest, "with -"+optContinueOnError+", write the versions and delete markers that failed to be deleted to this manifest file")
+	flag.StringVar(&o.retryFailed, optRetryFailed, defaultRetryFailed, "re-delete the versions and delete markers listed in this -"+optErrorManifest+" file of an earlier run, without applying the filters")
+	flag.StringVar(&o.configFile, optConfig, defaultConfig, "read the options from this JSON or YAML file, keyed by option name, e.g., max-keys or maxKeys; the command line takes precedence")
 	flag.Parse()
 
-	if quiet {
-		log.SetOutput(io.Discard)
-	} else {
-		log.SetOutput(os.Stderr)
+	if o.configFile != "" {
+		if err := applyConfigFile(flag.CommandLine, o.configFile); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Error: failed to read the -%s file: %v\n", optConfig, err)
+			os.Exit(exitUsage)
+		}
 	}
 
-	bucket := flag.Arg(0)
-	if bucket == "" {
+	if err := o.validate(); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		printUsage()
-		os.Exit(1)
+		os.Exit(exitUsage)
 	}
 
-	c := cleaner{
-		s3Client: &s3cli{
-			s3API: s3.New(session.Must(session.NewSession())),
-		},
-		bucket:  bucket,
-		maxKeys: 1000,
+	// the SDK doesn't apply DisableHTTPS to a custom endpoint, whose URL it takes as is, so the scheme is rewritten instead.
+	if o.disableSSL && len(o.endpointURL) >= len("https://") && strings.EqualFold(o.endpointURL[:len("https://")], "https://") {
+		o.endpointURL = "http://" + o.endpointURL[len("https://"):]
 	}
 
-	ctx := context.Background()
-	if timeout > 0 {
-		ctxWithTimeout, cancel := context.WithTimeout(ctx, 5*time.Minute)
-		defer cancel()
-		ctx = ctxWithTimeout
+	var denyList []string
+	if o.denyListFile != "" {
+		f, err := os.Open(o.denyListFile)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Error: failed to open the -%s file: %v\n", optDenyList, err)
+			os.Exit(exitConfig)
+		}
+		denyList, err = readList(f)
+		_ = f.Close()
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Error: failed to read the -%s file: %v\n", optDenyList, err)
+			os.Exit(exitConfig)
+		}
+	}
+
+	var commandFilter *cleanup.CommandFilter
+	if o.filterCommand != "" {
+		commandFilter = &cleanup.CommandFilter{Command: o.filterCommand}
+	}
+
+	var logOutput io.Writer = os.Stderr
+	logger := newLogger(logOutput, o.logFormat, o.level)
+	if o.correlationID == "" {
+		o.correlationID = os.Getenv(envCorrelationID)
+	}
+	if o.correlationID != "" {
+		logger = logger.With("correlationId", o.correlationID)
+	}
+	slog.SetDefault(logger)
+
+	if o.parsedTagFilter != nil {
+		logger.Warn("A GetObjectTagging call is made for each version to evaluate the tag filter, which adds to the request cost and slows down the run", "tagFilter", o.tagFilter)
+	}
+
+	buckets := flag.Args()
+	if o.stdin {
+		stdinBuckets, err := readList(os.Stdin)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Error: failed to read bucket names from stdin: %v\n", err)
+			os.Exit(exitUsage)
+		}
+		buckets = append(buckets, stdinBuckets...)
+	}
+	if len(buckets) == 0 && o.bucketRegexp == nil {
+		printUsage()
+		os.Exit(exitUsage)
+	}
+	for _, bucket := range buckets {
+		if err := validateBucketName(bucket); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Error: invalid bucket name %q: %v\n", bucket, err)
+			printUsage()
+			os.Exit(exitUsage)
+		}
 	}
 
-	deletedVersions, deletedDeleteMarker, err := c.cleanup(ctx)
+	// with -confirm-over, the buckets are confirmed once counted instead, and only if they're over the threshold.
+	stdinReader := bufio.NewReader(os.Stdin)
+	confirming := !o.dryRun && !o.listOnly && !o.yes && o.confirmOver > 0
+	if !o.dryRun && !o.listOnly && !o.yes && o.confirmOver == 0 {
+		if !isTerminal(os.Stdin) {
+			_, _ = fmt.Fprintf(os.Stderr, "Error: refusing to delete without confirmation in a non-interactive environment; pass -%s to proceed\n", optYes)
+			os.Exit(exitUsage)
+		}
+		for _, bucket := range buckets {
+			ok, err := confirm(stdinReader, os.Stderr, bucket, "all versions and delete markers")
+			if err != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "Error: failed to read confirmation: %v\n", err)
+				os.Exit(exitUsage)
+			}
+			if !ok {
+				_, _ = fmt.Fprintf(os.Stderr, "Aborted: the input didn't match the bucket name %q\n", bucket)
+				os.Exit(exitUsage)
+			}
+		}
+	}
+
+	// retries are handled by s3cli so that they can be bounded by -max-retries and the context deadline.
+	loadOpts := []func(*config.LoadOptions) error{
+		config.WithRetryer(func() aws.Retryer { return aws.NopRetryer{} }),
+	}
+	if o.region != "" {
+		loadOpts = append(loadOpts, config.WithRegion(o.region))
+	}
+	if o.profile != "" {
+		loadOpts = append(loadOpts, config.WithSharedConfigProfile(o.profile))
+	}
+	if o.httpTimeout > 0 || o.maxIdleConns > 0 || o.maxConnsPerHost > 0 {
+		loadOpts = append(loadOpts, config.WithHTTPClient(newHTTPClient(o.httpTimeout, o.maxIdleConns, o.maxConnsPerHost)))
+	}
+	cfg, err := config.LoadDefaultConfig(context.Background(), loadOpts...)
 	if err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		_, _ = fmt.Fprintf(os.Stderr, "Error: failed to load AWS configuration: %v\n", err)
+		os.Exit(exitConfig)
+	}
+	// the web identity token is exchanged explicitly rather than left to the default chain, which other variables or files may take precedence in.
+	if o.webIdentity {
+		tokenFile, webRoleARN := os.Getenv(envWebIdentityTokenFile), os.Getenv(envRoleARN)
+		if tokenFile == "" || webRoleARN == "" {
+			_, _ = fmt.Fprintf(os.Stderr, "Error: -%s requires the %s and %s environment variables\n", optWebIdentity, envWebIdentityTokenFile, envRoleARN)
+			os.Exit(exitConfig)
+		}
+		provider := stscreds.NewWebIdentityRoleProvider(sts.NewFromConfig(cfg), webRoleARN, stscreds.IdentityTokenFile(tokenFile), func(o *stscreds.WebIdentityRoleOptions) {
+			o.RoleSessionName = os.Getenv(envRoleSessionName)
+		})
+		cfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+	// the role is assumed with the credentials and the region resolved above, so -profile and -region apply to STS too.
+	// with -web-identity, it's chained after the web identity role.
+	if o.roleARN != "" {
+		provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), o.roleARN, func(opts *stscreds.AssumeRoleOptions) {
+			if o.externalID != "" {
+				opts.ExternalID = aws.String(o.externalID)
+			}
+		})
+		cfg.Credentials = aws.NewCredentialsCache(provider)
+	}
+	// retrieving the credentials upfront tells a credentials problem apart from the API errors of the run.
+	if _, err := cfg.Credentials.Retrieve(context.Background()); err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Error: failed to retrieve AWS credentials: %v\n", err)
+		os.Exit(exitConfig)
 	}
 
-	_, _ = fmt.Fprintf(os.Stdout, "Purged %d versions of objects and %d object delete makers from s3://%s\n", deletedVersions, deletedDeleteMarker, bucket)
-}
+	s3Options := func(opts *s3.Options) {
+		if o.endpointURL != "" {
+			opts.BaseEndpoint = aws.String(o.endpointURL)
+		}
+		opts.UsePathStyle = o.s3ForcePathStyle
+		opts.EndpointOptions.DisableHTTPS = o.disableSSL
+	}
+	api := s3.NewFromConfig(cfg, s3Options)
+	clientRegion := cfg.Region
+	regionalAPI := func(region string) *s3.Client {
+		return s3.NewFromConfig(cfg, s3Options, func(o *s3.Options) { o.Region = region })
+	}
 
-type (
-	cleaner struct {
-		s3Client
+	// the limiter is shared so that -rate-limit applies to the whole run rather than to each bucket.
+	var deleteLimiter *rate.Limiter
+	if o.rateLimit > 0 {
+		deleteLimiter = rate.NewLimiter(rate.Limit(o.rateLimit), 1)
+	}
 
-		bucket  string
-		maxKeys int64
+	metrics := cleanup.NewMetrics()
+	start := time.Now()
+	var stopAt time.Time
+	if o.maxRuntime > 0 {
+		stopAt = start.Add(o.maxRuntime)
 	}
 
-	s3Client interface {
-		listObjectVersions(ctx context.Context, bucket string, maxKeys int64, keyMarker, versionIdMarker *string) (versions []*object, deleteMarkers []*object, nextKeyMarker, nextVersionIdMarker *string, err error)
-		deleteObjects(ctx context.Context, bucket string, objects []*object) error
+	base := cleanup.Config{
+		MaxKeys:         o.maxKeys,
+		Prefix:          o.prefix,
+		Delimiter:       o.delimiter,
+		ShardPrefixes:   o.shards,
+		StartAfter:      o.startAfter,
+		StartVersionId:  o.startVersionId,
+		RampPaging:      o.rampPaging,
+		DryRun:          o.dryRun,
+		Workers:         o.workers,
+		DeleteBatchSize: o.deleteBatchSize,
+		MaxRetries:      o.maxRetries,
+		APITimeout:      o.apiTimeout,
+		DeleteLimiter:   deleteLimiter,
+		Metrics:         metrics,
+
+		BypassGovernance: o.bypassGovernance,
+		MFA:              o.mfa,
+		RequesterPays:    o.requesterPays,
+
+		ExpectedBucketOwner: o.bucketOwner,
+
+		OlderThan: o.olderThan,
+		Since:     o.sinceTime,
+		Until:     o.untilTime,
+		Include:   o.includeRegexp,
+		Exclude:   o.excludeRegexp,
+
+		KeepLatest:    o.keepLatest,
+		VersionsOnly:  o.versionsOnly,
+		MarkersOnly:   o.markersOnly,
+		MarkersLast:   o.markersLast,
+		CurrentOnly:   o.currentOnly,
+		KeepVersions:  o.keepVersions,
+		DenyList:      denyList,
+		TagFilter:     o.parsedTagFilter,
+		CommandFilter: commandFilter,
+		SampleRate:    o.sampleRate,
+
+		AbortMultipart: o.abortMultipart,
+
+		ContinueOnError: o.continueOnError,
+		IgnoreNotFound:  o.ignoreNotFound,
+
+		ProgressInterval: o.progressInterval,
+		LogObjects:       o.logObjects,
+		PrefixStats:      o.prefixStats,
+		ListRetention:    o.listRetention,
+		CheckpointFile:   o.checkpointFile,
+		StopAt:           stopAt,
+
+		Logger: logger,
 	}
 
-	s3cli struct {
-		s3API s3iface.S3API
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go handleSignals(cancel)
+
+	if o.timeout > 0 {
+		ctxWithTimeout, cancel := context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+		ctx = ctxWithTimeout
 	}
 
-	object struct {
-		Key       string
-		VersionId string
+	// the buckets' spans are children of a root span for the whole run, which is ended and exported right before exiting.
+	rootSpan := trace.SpanFromContext(ctx)
+	var tracerProvider *sdktrace.TracerProvider
+	if o.otelEnabled {
+		if tracerProvider, err = newTracerProvider(ctx); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Error: failed to set up OpenTelemetry: %v\n", err)
+			os.Exit(exitConfig)
+		}
+		base.Tracer = tracerProvider.Tracer(otelServiceName)
+		ctx, rootSpan = base.Tracer.Start(ctx, "cleanup", trace.WithAttributes(
+			attribute.Bool("dryRun", o.dryRun),
+			attribute.Bool("listOnly", o.listOnly),
+			attribute.String("correlationId", o.correlationID),
+		))
+	}
+
+	if o.bucketRegexp != nil {
+		matched, err := cleanup.ListBuckets(ctx, api, base, o.bucketRegexp)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Error: failed to list the buckets: %v\n", err)
+			os.Exit(exitError)
+		}
+		_, _ = fmt.Fprintf(os.Stderr, "%d buckets match -%s %s:\n", len(matched), optListBucketsMatching, o.bucketPattern)
+		for _, bucket := range matched {
+			_, _ = fmt.Fprintf(os.Stderr, "  %s\n", bucket)
+			if !slices.Contains(buckets, bucket) {
+				buckets = append(buckets, bucket)
+			}
+		}
+	}
+
+	// the earlier manifest is read before the new one is created, which may overwrite it.
+	var diff *manifestDiff
+	if o.diffManifest != "" {
+		if diff, err = loadManifestDiff(o.diffManifest); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Error: failed to read the manifest to compare with: %v\n", err)
+			os.Exit(exitConfig)
+		}
+	}
+
+	var manifest *manifestOutput
+	if o.listOnly {
+		format := cleanup.ManifestFormat(o.outputFile)
+		if o.batchOperations {
+			format = cleanup.ManifestFormatBatchOperations
+		}
+		manifest, err = createManifest(o.outputFile, format)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Error: failed to create the manifest file: %v\n", err)
+			os.Exit(exitConfig)
+		}
+		manifest.SetRetentionColumns(o.listRetention)
+	}
+
+	var errorManifest *manifestOutput
+	if o.errorManifestFile != "" {
+		errorManifest, err = createManifest(o.errorManifestFile, cleanup.ManifestFormat(o.errorManifestFile))
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Error: failed to create the error manifest file: %v\n", err)
+			os.Exit(exitConfig)
+		}
+		base.OnFailure = func(e *cleanup.ManifestEntry, _ error) {
+			errorManifest.write(e)
+		}
+	}
+
+	var events *eventStream
+	if o.streamEvents {
+		events = &eventStream{enc: json.NewEncoder(os.Stdout), dryRun: o.dryRun, logger: logger}
 	}
-)
 
-func (c *cleaner) cleanup(ctx context.Context) (deletedVersion, deletedDeleteMarker int, err error) {
 	var (
-		versions            []*object
-		deleteMarkers       []*object
-		nextKeyMarker       *string
-		nextVersionIdMarker *string
+		results = make([]*result, len(buckets))
+		code    = exitOK
+		// deletions counts the versions and delete markers deleted so far, against -max-deletes.
+		deletions int
+		// stopped tells that no more buckets are to be started, after a failure with -fail-fast, an interruption, or reaching -max-deletes or -max-runtime.
+		stopped bool
+
+		wg sync.WaitGroup
+		mu sync.Mutex
+		// sem bounds the number of buckets cleaned up at once to -parallel-buckets.
+		sem = make(chan struct{}, o.parallelBuckets)
 	)
+	for i, bucket := range buckets {
+		sem <- struct{}{}
+		mu.Lock()
+		stop := stopped
+		cfg := base
+		cfg.Bucket = bucket
+		// -max-deletes can't be combined with -parallel-buckets, so the previous buckets are done with by now.
+		if o.maxDeletes > 0 {
+			cfg.MaxDeletes = o.maxDeletes - deletions
+		}
+		mu.Unlock()
+		if stop {
+			break
+		}
+		if !stopAt.IsZero() && !time.Now().Before(stopAt) {
+			logger.Warn("Reached -"+optMaxRuntime+", leaving the remaining buckets untouched", "buckets", len(buckets)-i)
+			break
+		}
 
-	for {
-		versions, deleteMarkers, nextKeyMarker, nextVersionIdMarker, err = c.listObjectVersions(ctx, c.bucket, c.maxKeys, nextKeyMarker, nextVersionIdMarker)
-		if err != nil {
-			return deletedVersion, deletedDeleteMarker, fmt.Errorf("failed to list object versions: %w", err)
+		wg.Add(1)
+		go func(i int, bucket string, cfg cleanup.Config) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			// each bucket gets its own context, so that its cleanup can be told apart from the others'.
+			bucketCtx, cancelBucket := context.WithCancel(ctx)
+			defer cancelBucket()
+
+			r := &result{Result: &cleanup.Result{}, bucket: bucket, correlationID: o.correlationID}
+
+			// a failure to get the region is left to the cleanup to report, along with its hints.
+			var bucketAPI cleanup.S3API = api
+			if o.autoRegion {
+				if bucketRegion, err := cleanup.BucketRegion(bucketCtx, api, cfg); err == nil && bucketRegion != "" && bucketRegion != clientRegion {
+					logger.Info("The bucket is in another region, switching to a client for it", "bucket", bucket, "region", bucketRegion)
+					bucketAPI = regionalAPI(bucketRegion)
+				}
+			}
+			if events != nil {
+				cfg.OnBatch = events.batchDeleted(bucket)
+			}
+			c, err := cleanup.New(bucketAPI, cfg)
+
+			// the counting pass lists the bucket with the same options, so that the total matches what the deletion will go through.
+			var bar *progressBar
+			if err == nil && (o.countFirst || confirming) {
+				var total *cleanup.Result
+				if total, err = c.Count(bucketCtx); err != nil {
+					err = fmt.Errorf("failed to count versions and delete markers: %w", err)
+				} else if n := total.DeletedVersions + total.DeletedDeleteMarkers; confirming && n > o.confirmOver {
+					err = confirmCount(stdinReader, bucket, n, o.confirmOver)
+				}
+				if err == nil && o.countFirst {
+					interval := o.progressInterval
+					if interval == 0 {
+						interval = progressLogInterval
+					}
+					bar = &progressBar{
+						w:        logOutput,
+						tty:      !o.quiet && isTerminal(os.Stderr),
+						logger:   logger.With("bucket", bucket),
+						total:    total.DeletedVersions + total.DeletedDeleteMarkers,
+						interval: interval,
+					}
+					cfg.OnProgress = bar.update
+					c, err = cleanup.New(bucketAPI, cfg)
+				}
+			}
+
+			if err == nil && o.listOnly && diff != nil {
+				r.Result, r.diff, r.err = diff.list(bucketCtx, c, bucket, manifest.Write, logger.With("bucket", bucket))
+			} else if err == nil && o.listOnly {
+				r.Result, r.err = c.List(bucketCtx, manifest.Write)
+			} else if err == nil && o.fromManifest != "" {
+				r.Result, r.err = cleanupManifest(bucketCtx, o.fromManifest, c.CleanupManifest)
+			} else if err == nil && o.inventorySource != "" {
+				r.Result, r.err = c.CleanupInventory(bucketCtx, o.inventorySource)
+			} else if err == nil && o.retryFailed != "" {
+				r.Result, r.err = cleanupManifest(bucketCtx, o.retryFailed, c.RetryFailed)
+			} else if err == nil {
+				r.Result, r.err = c.Cleanup(bucketCtx)
+			} else {
+				r.err = err
+			}
+			if bar != nil {
+				bar.finish()
+			}
+			if r.err == nil && o.verify && bucketCtx.Err() == nil && !r.MaxDeletesReached && !r.StopAtReached {
+				var left *cleanup.Result
+				if left, r.err = c.Count(bucketCtx); r.err == nil {
+					remaining := left.DeletedVersions + left.DeletedDeleteMarkers
+					r.remaining = &remaining
+					if remaining > 0 {
+						logger.Warn("Versions or delete markers remain after the cleanup", "bucket", bucket, "versions", left.DeletedVersions, "deleteMarkers", left.DeletedDeleteMarkers)
+					}
+				} else {
+					r.err = fmt.Errorf("failed to verify the cleanup: %w", r.err)
+				}
+			}
+			if r.err == nil && o.deleteBucket && bucketCtx.Err() == nil && !r.MaxDeletesReached && !r.StopAtReached {
+				if r.err = c.DeleteBucket(bucketCtx); r.err == nil {
+					r.bucketDeleted = true
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			results[i] = r
+			deletions += r.DeletedVersions + r.DeletedDeleteMarkers
+			// the exit code reflects the first failure.
+			if code == exitOK {
+				code = exitCode(ctx, r, o.failOnEmpty)
+			}
+			if r.err != nil {
+				// check the context itself to tell a timeout from an ordinary API failure;
+				// a retry loop giving up near the deadline reports the last API error rather than a context error.
+				if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+					_, _ = fmt.Fprintf(os.Stderr, "Error: s3://%s: operation timed out after %s: %v\n", bucket, o.timeout, r.err)
+				} else if errors.Is(ctx.Err(), context.Canceled) {
+					_, _ = fmt.Fprintf(os.Stderr, "Error: s3://%s: interrupted: %v\n", bucket, r.err)
+				} else if !o.debug && (errors.Is(r.err, cleanup.ErrBucketNotFound) || errors.Is(r.err, cleanup.ErrAccessDenied)) {
+					// the wrapped SDK errors are mostly noise for a typo in a bucket name; -debug shows them.
+					_, _ = fmt.Fprintf(os.Stderr, "Error: bucket %q does not exist or you lack permission to access it (pass -%s for the original error)\n", bucket, optDebug)
+				} else {
+					_, _ = fmt.Fprintf(os.Stderr, "Error: s3://%s: %v\n", bucket, r.err)
+				}
+				var wrongRegion *cleanup.WrongRegionError
+				if errors.As(r.err, &wrongRegion) {
+					_, _ = fmt.Fprintf(os.Stderr, "Hint: the bucket is in %s; pass -%s %s, or -%s to switch regions automatically\n", wrongRegion.Region, optRegion, wrongRegion.Region, optAutoRegion)
+				} else if errors.Is(r.err, cleanup.ErrWrongRegion) {
+					_, _ = fmt.Fprintf(os.Stderr, "Hint: pass the region of the bucket with -%s\n", optRegion)
+				}
+				if o.bucketOwner != "" && errors.Is(r.err, cleanup.ErrAccessDenied) {
+					_, _ = fmt.Fprintf(os.Stderr, "Hint: the bucket may belong to another account than -%s %s\n", optExpectedBucketOwner, o.bucketOwner)
+				}
+				if errors.Is(r.err, cleanup.ErrBucketNotEmpty) {
+					_, _ = fmt.Fprintf(os.Stderr, "Hint: the prefix or the filters may have kept some versions or delete markers, or new objects may have been written\n")
+				}
+				if errors.Is(r.err, cleanup.ErrKMSPermission) {
+					_, _ = fmt.Fprintf(os.Stderr, "Hint: grant kms:Decrypt and kms:GenerateDataKey on the KMS keys of the objects to the credentials in use\n")
+				}
+				if errors.Is(r.err, cleanup.ErrMFARequired) {
+					_, _ = fmt.Fprintf(os.Stderr, "Hint: pass the MFA device serial number and the current token code with -%s \"<serial> <token>\"\n", optMFA)
+				}
+			}
+
+			if r.err != nil && (o.failFast || ctx.Err() != nil) {
+				stopped = true
+			}
+			// the remaining buckets are left untouched once the cap is reached.
+			if r.MaxDeletesReached || (o.maxDeletes > 0 && deletions >= o.maxDeletes) || r.StopAtReached {
+				stopped = true
+			}
+		}(i, bucket, cfg)
+	}
+	wg.Wait()
+
+	// buckets that were never started have no result.
+	finished := results[:0]
+	for _, r := range results {
+		if r != nil {
+			finished = append(finished, r)
 		}
+	}
+	results = finished
 
-		if len(versions) > 0 {
-			if err := c.deleteVersions(ctx, versions); err != nil {
-				return deletedVersion, deletedDeleteMarker, fmt.Errorf("failed to delete versions: %w", err)
+	// the manifest is closed before the summary so that a failure to write it is reported along with the other errors.
+	if manifest != nil {
+		if err := manifest.Close(); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Error: failed to write the manifest file: %v\n", err)
+			if code == exitOK {
+				code = exitError
 			}
-			deletedVersion += len(versions)
 		}
+	}
+	if errorManifest != nil {
+		if err := errorManifest.Close(); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Error: failed to write the error manifest file: %v\n", err)
+			if code == exitOK {
+				code = exitError
+			}
+		}
+	}
 
-		if len(deleteMarkers) > 0 {
-			if err := c.deleteDeleteMarkers(ctx, deleteMarkers); err != nil {
-				return 0, 0, fmt.Errorf("failed to delete delete markers: %w", err)
+	m := newMetricsReport(metrics, results, time.Since(start))
+	if !o.quiet {
+		printMetrics(os.Stderr, m)
+	}
+	if o.metricsFile != "" {
+		if err := writeMetrics(o.metricsFile, m); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Error: failed to write the metrics file: %v\n", err)
+			if code == exitOK {
+				code = exitError
 			}
-			deletedDeleteMarker += len(deleteMarkers)
 		}
+	}
 
-		// probably it's not necessary to check the length of versions and deleteMarkers;
-		// i.e., if nextKeyMarker and nextVersionIdMarker are nil, it means that there are no more versions and delete markers.
-		// but just in case, check the length of versions and deleteMarkers, which might cause one more (unnecessary) API call.
-		if len(versions) == 0 && len(deleteMarkers) == 0 && nextKeyMarker == nil && nextVersionIdMarker == nil {
+	if o.cwNamespace != "" {
+		// the SDK's retries are disabled for S3, whose calls s3cli retries itself, but not for CloudWatch.
+		cw := cloudwatch.NewFromConfig(cfg, func(o *cloudwatch.Options) { o.Retryer = retry.NewStandard() })
+		if err := publishCloudWatch(cw, o.cwNamespace, results); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Error: failed to publish the metrics to CloudWatch: %v\n", err)
+			if code == exitOK {
+				code = exitError
+			}
+		}
+	}
+
+	if o.summaryFile != "" {
+		if err := writeSummary(o.summaryFile, newRunSummary(o.correlationID, o.dryRun, o.listOnly, results, m)); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Error: failed to write the summary file: %v\n", err)
+			if code == exitOK {
+				code = exitError
+			}
+		}
+	}
+
+	// the JSON summary is printed even in quiet mode since it was explicitly asked for.
+	// with -stream-events, it goes to stderr, so that stdout only carries the events.
+	summaryOutput := io.Writer(os.Stdout)
+	if o.streamEvents {
+		summaryOutput = os.Stderr
+	}
+	for _, r := range results {
+		if o.quiet && o.output == outputText {
 			break
 		}
+		if err := printResult(summaryOutput, o.output, o.dryRun, o.listOnly, r); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Error: failed to write summary: %v\n", err)
+			os.Exit(exitError)
+		}
 	}
 
-	return deletedVersion, deletedDeleteMarker, nil
+	// an interruption takes precedence, since the remaining buckets weren't processed.
+	if code != exitOK && ctx.Err() != nil {
+		code = exitInterrupted
+	}
+
+	if tracerProvider != nil {
+		rootSpan.SetAttributes(attribute.Int("buckets", len(results)), attribute.Int("exitCode", code))
+		if code != exitOK {
+			rootSpan.SetStatus(codes.Error, fmt.Sprintf("exited with code %d", code))
+		}
+		rootSpan.End()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), otelShutdownTimeout)
+		if err := tracerProvider.Shutdown(shutdownCtx); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Error: failed to export the OpenTelemetry spans: %v\n", err)
+		}
+		cancel()
+	}
+	os.Exit(code)
 }
 
-func (c *cleaner) deleteVersions(ctx context.Context, versions []*object) error {
-	if err := c.deleteObjects(ctx, c.bucket, versions); err != nil {
-		return fmt.Errorf("failed to delete versions: %w", err)
+// validate checks the options for bad values and combinations, returning the usage error to report,
+// and parses the ones that need it into the fields set by validate.
+func (o *options) validate() error {
+	if o.maxKeys < cleanup.MinMaxKeys || o.maxKeys > cleanup.MaxMaxKeys {
+		return fmt.Errorf("-%s must be between %d and %d, got %d", optMaxKeys, cleanup.MinMaxKeys, cleanup.MaxMaxKeys, o.maxKeys)
+	}
+
+	if o.output != outputText && o.output != outputJSON {
+		return fmt.Errorf("-%s must be %s or %s, got %q", optOutput, outputText, outputJSON, o.output)
+	}
+
+	// SigV2 is rejected rather than silently signing with SigV4, which a SigV2-only store would fail on with a less obvious error.
+	// "s3v4" and "s3" are the names of the AWS CLI's signature_version setting.
+	switch strings.ToLower(o.signatureVersion) {
+	case signatureV4, "s3v4":
+	case signatureV2, "s3":
+		return fmt.Errorf("-%s %s isn't supported: the AWS SDK for Go v2 only signs requests with Signature Version 4", optS3SignatureVersion, o.signatureVersion)
+	default:
+		return fmt.Errorf("-%s must be %s, got %q", optS3SignatureVersion, signatureV4, o.signatureVersion)
+	}
+
+	if o.deleteBatchSize < cleanup.MinDeleteBatchSize || o.deleteBatchSize > cleanup.MaxDeleteBatchSize {
+		return fmt.Errorf("-%s must be between %d and %d, got %d", optDeleteBatchSize, cleanup.MinDeleteBatchSize, cleanup.MaxDeleteBatchSize, o.deleteBatchSize)
+	}
+	if o.workers < 1 {
+		return fmt.Errorf("-%s must be at least 1, got %d", optWorkers, o.workers)
+	}
+	if o.maxRetries < 0 {
+		return fmt.Errorf("-%s must not be negative, got %d", optMaxRetries, o.maxRetries)
+	}
+	if o.rateLimit < 0 {
+		return fmt.Errorf("-%s must not be negative, got %g", optRateLimit, o.rateLimit)
+	}
+	if o.olderThan < 0 {
+		return fmt.Errorf("-%s must not be negative, got %s", optOlderThan, o.olderThan)
+	}
+	if o.since != "" {
+		t, err := time.Parse(time.RFC3339, o.since)
+		if err != nil {
+			return fmt.Errorf("invalid -%s time: %w", optSince, err)
+		}
+		o.sinceTime = t
+	}
+	if o.until != "" {
+		t, err := time.Parse(time.RFC3339, o.until)
+		if err != nil {
+			return fmt.Errorf("invalid -%s time: %w", optUntil, err)
+		}
+		o.untilTime = t
+	}
+	if !o.sinceTime.IsZero() && !o.untilTime.IsZero() && !o.sinceTime.Before(o.untilTime) {
+		return fmt.Errorf("-%s must be before -%s", optSince, optUntil)
+	}
+	if o.include != "" {
+		re, err := regexp.Compile(o.include)
+		if err != nil {
+			return fmt.Errorf("invalid -%s regular expression: %w", optInclude, err)
+		}
+		o.includeRegexp = re
+	}
+	if o.exclude != "" {
+		re, err := regexp.Compile(o.exclude)
+		if err != nil {
+			return fmt.Errorf("invalid -%s regular expression: %w", optExclude, err)
+		}
+		o.excludeRegexp = re
+	}
+	if o.bucketPattern != "" {
+		re, err := regexp.Compile(o.bucketPattern)
+		if err != nil {
+			return fmt.Errorf("invalid -%s regular expression: %w", optListBucketsMatching, err)
+		}
+		o.bucketRegexp = re
+	}
+	// the matched buckets aren't known until the listing, so they can't be confirmed one by one.
+	if o.bucketRegexp != nil && !o.yes && !o.dryRun && !o.listOnly {
+		return fmt.Errorf("-%s requires -%s", optListBucketsMatching, optYes)
+	}
+	if o.apiTimeout < 0 {
+		return fmt.Errorf("-%s must not be negative, got %s", optAPITimeout, o.apiTimeout)
+	}
+	if o.failOnEmpty < 0 || o.failOnEmpty > 125 {
+		return fmt.Errorf("-%s must be between 0 and 125, got %d", optFailOnEmpty, o.failOnEmpty)
+	}
+	if o.httpTimeout < 0 {
+		return fmt.Errorf("-%s must not be negative, got %s", optHTTPTimeout, o.httpTimeout)
+	}
+	if o.maxIdleConns < 0 || o.maxConnsPerHost < 0 {
+		return fmt.Errorf("-%s and -%s must not be negative, got %d and %d", optMaxIdleConns, optMaxConnsPerHost, o.maxIdleConns, o.maxConnsPerHost)
+	}
+	if o.progressInterval < 0 {
+		return fmt.Errorf("-%s must not be negative, got %s", optProgressInterval, o.progressInterval)
+	}
+	if o.logFormat != logFormatText && o.logFormat != logFormatJSON {
+		return fmt.Errorf("-%s must be %s or %s, got %q", optLogFormat, logFormatText, logFormatJSON, o.logFormat)
+	}
+
+	if o.listOnly && o.outputFile == "" {
+		return fmt.Errorf("-%s requires -%s", optListOnly, optOutputFile)
+	}
+	if o.batchOperations && !o.listOnly {
+		return fmt.Errorf("-%s is only valid with -%s", optBatchOperations, optListOnly)
+	}
+	if o.listRetention && (!o.listOnly || o.batchOperations) {
+		return fmt.Errorf("-%s is only valid with -%s, and not with -%s", optListRetention, optListOnly, optBatchOperations)
+	}
+	if o.diffManifest != "" && !o.listOnly {
+		return fmt.Errorf("-%s is only valid with -%s", optDiffManifest, optListOnly)
+	}
+	if o.outputFile != "" && !o.listOnly {
+		return fmt.Errorf("-%s is only valid with -%s", optOutputFile, optListOnly)
+	}
+
+	if o.fromManifest != "" && o.listOnly {
+		return fmt.Errorf("-%s and -%s are mutually exclusive", optFromManifest, optListOnly)
+	}
+
+	// the report is read like a manifest, so the options that don't apply to -from-manifest don't apply to it either.
+	if o.inventorySource != "" && (o.listOnly || o.fromManifest != "" || o.retryFailed != "" || o.checkpointFile != "" || o.startAfter != "" || o.countFirst || o.verify || o.confirmOver > 0) {
+		return fmt.Errorf("-%s can't be used with -%s, -%s, -%s, -%s, -%s, -%s, -%s, or -%s", optInventorySource,
+			optListOnly, optFromManifest, optRetryFailed, optCheckpointFile, optStartAfter, optCountFirst, optVerify, optConfirmOver)
+	}
+
+	if o.retryFailed != "" && (o.listOnly || o.fromManifest != "") {
+		return fmt.Errorf("-%s can't be used with -%s or -%s", optRetryFailed, optListOnly, optFromManifest)
+	}
+	// the error manifest is created before the buckets are processed, which would wipe the manifest being retried.
+	if o.retryFailed != "" && o.retryFailed == o.errorManifestFile {
+		return fmt.Errorf("-%s and -%s must be different files", optRetryFailed, optErrorManifest)
+	}
+
+	if o.startVersionId != "" && o.startAfter == "" {
+		return fmt.Errorf("-%s requires -%s", optStartVersionId, optStartAfter)
+	}
+	if o.startAfter != "" && (o.fromManifest != "" || o.retryFailed != "") {
+		return fmt.Errorf("-%s can't be used with -%s or -%s", optStartAfter, optFromManifest, optRetryFailed)
+	}
+
+	if o.checkpointFile != "" && (o.listOnly || o.fromManifest != "" || o.retryFailed != "") {
+		return fmt.Errorf("-%s can't be used with -%s, -%s, or -%s", optCheckpointFile, optListOnly, optFromManifest, optRetryFailed)
+	}
+
+	if o.sampleRate <= 0 || o.sampleRate > 1 {
+		return fmt.Errorf("-%s must be greater than 0 and at most 1, got %g", optSampleRate, o.sampleRate)
+	}
+	if o.errorManifestFile != "" && !o.continueOnError {
+		return fmt.Errorf("-%s is only valid with -%s", optErrorManifest, optContinueOnError)
+	}
+	if o.keepVersions < 0 {
+		return fmt.Errorf("-%s must not be negative, got %d", optKeepVersions, o.keepVersions)
+	}
+	if o.currentOnly && (o.keepLatest || o.keepVersions > 0) {
+		return fmt.Errorf("-%s can't be used with -%s or -%s", optCurrentOnly, optKeepLatest, optKeepVersions)
+	}
+	if o.versionsOnly && o.markersOnly {
+		return fmt.Errorf("-%s and -%s are mutually exclusive", optVersionsOnly, optMarkersOnly)
+	}
+	if o.markersOnly && o.currentOnly {
+		return fmt.Errorf("-%s can't be used with -%s", optMarkersOnly, optCurrentOnly)
+	}
+	if o.markersLast && o.checkpointFile != "" {
+		return fmt.Errorf("-%s can't be used with -%s", optMarkersLast, optCheckpointFile)
+	}
+	if o.keepVersions > 0 && o.checkpointFile != "" {
+		return fmt.Errorf("-%s can't be used with -%s", optKeepVersions, optCheckpointFile)
+	}
+
+	if o.shardPrefixes != "" {
+		for _, shard := range strings.Split(o.shardPrefixes, ",") {
+			if shard = strings.TrimSpace(shard); shard != "" {
+				o.shards = append(o.shards, shard)
+			}
+		}
+	}
+	if len(o.shards) > 0 && o.checkpointFile != "" {
+		return fmt.Errorf("-%s can't be used with -%s", optShardPrefixes, optCheckpointFile)
+	}
+
+	if o.tagFilter != "" {
+		f, err := cleanup.ParseTagFilter(o.tagFilter)
+		if err != nil {
+			return fmt.Errorf("invalid -%s: %w", optTagFilter, err)
+		}
+		o.parsedTagFilter = f
+	}
+
+	if o.externalID != "" && o.roleARN == "" {
+		return fmt.Errorf("-%s requires -%s", optExternalID, optRoleARN)
+	}
+
+	if o.bucketOwner != "" && !accountIDPattern.MatchString(o.bucketOwner) {
+		return fmt.Errorf("-%s must be a 12-digit AWS account ID, got %q", optExpectedBucketOwner, o.bucketOwner)
+	}
+
+	if o.parallelBuckets < 1 {
+		return fmt.Errorf("-%s must be at least 1, got %d", optParallelBuckets, o.parallelBuckets)
+	}
+	// the budget of a bucket depends on what the previous ones deleted, and progress bars can't share the terminal.
+	if o.parallelBuckets > 1 && (o.maxDeletes > 0 || o.countFirst) {
+		return fmt.Errorf("-%s can't be used with -%s or -%s", optParallelBuckets, optMaxDeletes, optCountFirst)
+	}
+
+	if o.maxDeletes < 0 {
+		return fmt.Errorf("-%s must not be negative, got %d", optMaxDeletes, o.maxDeletes)
+	}
+
+	if o.maxRuntime < 0 {
+		return fmt.Errorf("-%s must not be negative, got %s", optMaxRuntime, o.maxRuntime)
+	}
+	if o.maxRuntime > 0 && o.listOnly {
+		return fmt.Errorf("-%s can't be used with -%s", optMaxRuntime, optListOnly)
+	}
+
+	if o.verify && (o.dryRun || o.listOnly || o.fromManifest != "" || o.retryFailed != "") {
+		return fmt.Errorf("-%s can't be used with -%s, -%s, -%s, or -%s", optVerify, optDryRun, optListOnly, optFromManifest, optRetryFailed)
+	}
+	// a sampled cleanup leaves the unsampled versions behind on purpose.
+	if o.verify && o.sampleRate < 1 {
+		return fmt.Errorf("-%s can't be used with -%s", optVerify, optSampleRate)
+	}
+
+	if o.cwNamespace != "" && (o.dryRun || o.listOnly) {
+		return fmt.Errorf("-%s can't be used with -%s or -%s", optCloudWatchNamespace, optDryRun, optListOnly)
+	}
+
+	if o.deleteBucket && (o.dryRun || o.listOnly) {
+		return fmt.Errorf("-%s can't be used with -%s or -%s", optDeleteBucket, optDryRun, optListOnly)
+	}
+
+	if o.confirmOver < 0 {
+		return fmt.Errorf("-%s must not be negative, got %d", optConfirmOver, o.confirmOver)
+	}
+	if o.confirmOver > 0 && (o.listOnly || o.fromManifest != "" || o.retryFailed != "") {
+		return fmt.Errorf("-%s can't be used with -%s, -%s, or -%s", optConfirmOver, optListOnly, optFromManifest, optRetryFailed)
+	}
+	// the prompts of the buckets can't share the terminal.
+	if o.confirmOver > 0 && !o.yes && o.parallelBuckets > 1 {
+		return fmt.Errorf("-%s can't be used with -%s unless with -%s", optConfirmOver, optParallelBuckets, optYes)
+	}
+
+	if o.countFirst && (o.listOnly || o.fromManifest != "" || o.retryFailed != "") {
+		return fmt.Errorf("-%s can't be used with -%s, -%s, or -%s", optCountFirst, optListOnly, optFromManifest, optRetryFailed)
+	}
+
+	// -quiet and -debug only pick the default level, so that an explicit -log-level wins.
+	o.level = slog.LevelInfo
+	switch {
+	case o.logLevel != "":
+		var ok bool
+		if o.level, ok = parseLogLevel(o.logLevel); !ok {
+			return fmt.Errorf("-%s must be debug, info, warn, or error, got %q", optLogLevel, o.logLevel)
+		}
+	case o.quiet:
+		o.level = slog.LevelError
+	case o.debug:
+		o.level = slog.LevelDebug
+	}
+
+	if o.logObjects && o.quiet {
+		return fmt.Errorf("-%s can't be used with -%s", optLogObjects, optQuiet)
+	}
+	if o.logObjects && o.level > slog.LevelInfo {
+		return fmt.Errorf("-%s requires -%s debug or info, got %q", optLogObjects, optLogLevel, o.logLevel)
 	}
-	log.Printf("Deleted %d versions", len(versions))
 	return nil
 }
 
-func (c *cleaner) deleteDeleteMarkers(ctx context.Context, deleteMarkers []*object) error {
-	if err := c.deleteObjects(ctx, c.bucket, deleteMarkers); err != nil {
-		return fmt.Errorf("failed to delete delete markers: %w", err)
+// newTracerProvider creates the tracer provider of -otel, which exports the spans with OTLP over HTTP in batches.
+// The exporter and the resource are configured by the standard OTEL_* environment variables, e.g., OTEL_EXPORTER_OTLP_ENDPOINT.
+func newTracerProvider(ctx context.Context) (*sdktrace.TracerProvider, error) {
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", otelServiceName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res)), nil
+}
+
+// exitCode tells the exit code of the result of a bucket: exitOK unless it failed, versions or delete markers remain after -verify,
+// or it had nothing to delete with -fail-on-empty, given as failOnEmpty.
+func exitCode(ctx context.Context, r *result, failOnEmpty int) int {
+	var apiErr smithy.APIError
+	switch {
+	case r.remaining != nil && *r.remaining > 0:
+		return exitRemaining
+	case failOnEmpty > 0 && r.empty():
+		return failOnEmpty
+	case r.err == nil:
+		return exitOK
+	case ctx.Err() != nil:
+		return exitInterrupted
+	case errors.Is(r.err, errNotConfirmed), errors.Is(r.err, cleanup.ErrUnsupportedInventoryFormat):
+		return exitUsage
+	case errors.Is(r.err, cleanup.ErrWrongRegion), errors.Is(r.err, cleanup.ErrMFARequired):
+		return exitConfig
+	case errors.As(r.err, &apiErr) && isCredentialsError(apiErr.ErrorCode()):
+		return exitConfig
+	case r.FailedObjects > 0, errors.Is(r.err, cleanup.ErrObjectsNotDeleted):
+		return exitPartialFailure
+	default:
+		return exitError
+	}
+}
+
+// newHTTPClient creates the HTTP client of the SDK with the given timeout and connection pool sizes, zero keeping the SDK's defaults.
+// The idle connections are capped per host as well as in total, since the requests all go to the few S3 endpoints.
+func newHTTPClient(timeout time.Duration, maxIdleConns, maxConnsPerHost int) *awshttp.BuildableClient {
+	return awshttp.NewBuildableClient().WithTimeout(timeout).WithTransportOptions(func(tr *http.Transport) {
+		if maxIdleConns > 0 {
+			tr.MaxIdleConns = maxIdleConns
+			tr.MaxIdleConnsPerHost = maxIdleConns
+		}
+		tr.MaxConnsPerHost = maxConnsPerHost
+	})
+}
+
+// isCredentialsError reports whether an S3 error code means that the credentials are invalid or expired.
+func isCredentialsError(code string) bool {
+	switch code {
+	case "InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken", "TokenRefreshRequired", "InvalidToken":
+		return true
+	}
+	return false
+}
+
+// createManifest creates a manifest file at path in the given format, gzip-compressed if it ends with ".gz".
+func createManifest(path, format string) (*manifestOutput, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &manifestOutput{f: f}
+	var w io.Writer = f
+	if isGzip(path) {
+		m.gz = gzip.NewWriter(f)
+		w = m.gz
+	}
+	m.buf = bufio.NewWriter(w)
+	if m.ManifestWriter, err = cleanup.NewManifestWriter(m.buf, format); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// isGzip reports whether the file name implies gzip compression.
+func isGzip(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".gz")
+}
+
+// Write writes an entry. It's safe for concurrent use, as buckets may be cleaned up in parallel.
+func (m *manifestOutput) Write(e *cleanup.ManifestEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ManifestWriter.Write(e)
+}
+
+// write writes an entry for a caller that can't handle the error, which is reported by Close instead.
+func (m *manifestOutput) write(e *cleanup.ManifestEntry) {
+	if err := m.Write(e); err != nil {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.err == nil {
+			m.err = err
+		}
+	}
+}
+
+// Close flushes and closes the manifest file. The file is closed even if flushing fails.
+func (m *manifestOutput) Close() error {
+	err := errors.Join(m.err, m.Flush(), m.buf.Flush())
+	// closing the gzip writer writes the footer, without which the file can't be decompressed.
+	if m.gz != nil {
+		err = errors.Join(err, m.gz.Close())
+	}
+	return errors.Join(err, m.f.Close())
+}
+
+// batchDeleted returns the Config.OnBatch of a bucket, which writes a batch_deleted event.
+// It's safe for concurrent use, as buckets may be cleaned up in parallel.
+func (s *eventStream) batchDeleted(bucket string) func(bool, int, cleanup.Result) {
+	return func(deleteMarkers bool, deleted int, total cleanup.Result) {
+		e := &event{
+			Event:      eventBatchDeleted,
+			Bucket:     bucket,
+			Count:      deleted,
+			Type:       eventTypeVersion,
+			Cumulative: total.DeletedVersions + total.DeletedDeleteMarkers,
+			DryRun:     s.dryRun,
+		}
+		if deleteMarkers {
+			e.Type = eventTypeDeleteMarker
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		// a consumer going away mustn't stop the cleanup, so the failure is only logged once.
+		if err := s.enc.Encode(e); err != nil && !s.failed {
+			s.failed = true
+			s.logger.Warn("Failed to write an event to stdout", "error", err)
+		}
+	}
+}
+
+// cleanupManifest deletes the versions and delete markers listed in the manifest file at path with fn, either Cleaner.CleanupManifest or Cleaner.RetryFailed.
+// The file is read for each bucket, so that a manifest covering several buckets can be passed along with all of them.
+func cleanupManifest(ctx context.Context, path string, fn func(context.Context, *cleanup.ManifestReader) (*cleanup.Result, error)) (*cleanup.Result, error) {
+	r, closeManifest, err := openManifest(path)
+	if err != nil {
+		return &cleanup.Result{}, err
+	}
+	defer closeManifest()
+	return fn(ctx, r)
+}
+
+// openManifest opens the manifest file at path for reading, decompressing it if it ends with ".gz".
+// The returned function closes it.
+func openManifest(path string) (*cleanup.ManifestReader, func(), error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open the manifest file: %w", err)
+	}
+
+	var in io.Reader = f
+	closeManifest := func() { _ = f.Close() }
+	if isGzip(path) {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			_ = f.Close()
+			return nil, nil, fmt.Errorf("failed to decompress the manifest file: %w", err)
+		}
+		in = gz
+		closeManifest = func() { _ = gz.Close(); _ = f.Close() }
+	}
+
+	r, err := cleanup.NewManifestReader(bufio.NewReader(in), cleanup.ManifestFormat(path))
+	if err != nil {
+		closeManifest()
+		return nil, nil, err
+	}
+	return r, closeManifest, nil
+}
+
+// loadManifestDiff reads the manifest file at path to compare the listings with.
+func loadManifestDiff(path string) (*manifestDiff, error) {
+	r, closeManifest, err := openManifest(path)
+	if err != nil {
+		return nil, err
+	}
+	defer closeManifest()
+
+	d := &manifestDiff{previous: make(map[manifestKey]bool)}
+	for {
+		e, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			return d, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		d.previous[manifestKey{bucket: e.Bucket, key: e.Key, versionId: e.VersionId, deleteMarker: e.IsDeleteMarker}] = false
+	}
+}
+
+// list lists the bucket with c like Cleaner.List, writing the entries with write, and compares them with the earlier manifest.
+// Each added and removed version or delete marker is logged. The removed ones are only told once the listing completes.
+func (d *manifestDiff) list(ctx context.Context, c *cleanup.Cleaner, bucket string, write func(*cleanup.ManifestEntry) error, logger *slog.Logger) (*cleanup.Result, *diffResult, error) {
+	var dr diffResult
+	r, err := c.List(ctx, func(e *cleanup.ManifestEntry) error {
+		k := manifestKey{bucket: e.Bucket, key: e.Key, versionId: e.VersionId, deleteMarker: e.IsDeleteMarker}
+		d.mu.Lock()
+		_, ok := d.previous[k]
+		if ok {
+			d.previous[k] = true
+		}
+		d.mu.Unlock()
+		if !ok {
+			dr.Added++
+			logger.Info("Added since the earlier manifest", "key", e.Key, "versionId", e.VersionId, "deleteMarker", e.IsDeleteMarker)
+		}
+		return write(e)
+	})
+	if err != nil || ctx.Err() != nil {
+		return r, nil, err
+	}
+
+	d.mu.Lock()
+	var removed []manifestKey
+	for k, seen := range d.previous {
+		if k.bucket == bucket && !seen {
+			removed = append(removed, k)
+		}
+	}
+	d.mu.Unlock()
+	sort.Slice(removed, func(i, j int) bool {
+		return removed[i].key < removed[j].key || (removed[i].key == removed[j].key && removed[i].versionId < removed[j].versionId)
+	})
+	for _, k := range removed {
+		logger.Info("Removed since the earlier manifest", "key", k.key, "versionId", k.versionId, "deleteMarker", k.deleteMarker)
+	}
+	dr.Removed = len(removed)
+	return r, &dr, nil
+}
+
+// handleSignals cancels the run on the first SIGINT or SIGTERM so that it stops after the in-flight DeleteObjects calls
+// and prints a partial summary. A second signal exits immediately.
+func handleSignals(cancel context.CancelFunc) {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	sig := <-sigs
+	_, _ = fmt.Fprintf(os.Stderr, "Received %s, stopping after the in-flight DeleteObjects calls; send it again to exit immediately\n", sig)
+	cancel()
+
+	<-sigs
+	_, _ = fmt.Fprintln(os.Stderr, "Exiting immediately")
+	os.Exit(130)
+}
+
+// isTerminal reports whether f is an interactive terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// validateBucketName checks the name against the S3 bucket naming rules, so that a typo is reported before any API call.
+func validateBucketName(name string) error {
+	switch {
+	case len(name) < 3 || len(name) > 63:
+		return fmt.Errorf("must be 3 to 63 characters long, got %d", len(name))
+	case !bucketNamePattern.MatchString(name):
+		return errors.New("must only contain lowercase letters, digits, dots, and hyphens, and start and end with a letter or a digit")
+	case strings.Contains(name, ".."):
+		return errors.New("must not contain two adjacent dots")
+	case net.ParseIP(name) != nil:
+		return errors.New("must not be formatted as an IP address")
+	}
+	for _, prefix := range reservedBucketPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return fmt.Errorf("must not start with the reserved prefix %q", prefix)
+		}
+	}
+	for _, suffix := range reservedBucketSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return fmt.Errorf("must not end with the reserved suffix %q", suffix)
+		}
+	}
+	return nil
+}
+
+// confirm asks the user to type the bucket name to proceed with the irreversible deletion of what in the bucket.
+func confirm(in *bufio.Reader, out io.Writer, bucket, what string) (bool, error) {
+	_, _ = fmt.Fprintf(out, "This will permanently delete %s in s3://%s.\nType the bucket name to confirm: ", what, bucket)
+	line, err := in.ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, err
+	}
+	return strings.TrimSpace(line) == bucket, nil
+}
+
+// confirmCount asks for the confirmation of -confirm-over for a bucket with n versions and delete markers to delete,
+// returning errNotConfirmed if it's declined or can't be asked for since stdin isn't a terminal.
+func confirmCount(in *bufio.Reader, bucket string, n, threshold int) error {
+	if !isTerminal(os.Stdin) {
+		return fmt.Errorf("%w: %d versions and delete markers to delete, over -%s %d, in a non-interactive environment; pass -%s to proceed", errNotConfirmed, n, optConfirmOver, threshold, optYes)
+	}
+	ok, err := confirm(in, os.Stderr, bucket, fmt.Sprintf("%d versions and delete markers, over -%s %d,", n, optConfirmOver, threshold))
+	if err != nil {
+		return fmt.Errorf("failed to read confirmation: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("%w: the input didn't match the bucket name %q", errNotConfirmed, bucket)
 	}
-	log.Printf("Deleted %d delete markers", len(deleteMarkers))
 	return nil
 }
 
-func (c *s3cli) listObjectVersions(ctx context.Context, bucket string, maxKeys int64, keyMarker, versionIdMarker *string) (versions []*object, deleteMarkers []*object, nextKeyMarker, nextVersionIdMarker *string, err error) {
-	input := s3.ListObjectVersionsInput{
-		Bucket:          aws.String(bucket),
-		MaxKeys:         aws.Int64(maxKeys),
-		KeyMarker:       keyMarker,
-		VersionIdMarker: versionIdMarker,
+// parseLogLevel parses a -log-level value, case-insensitively.
+func parseLogLevel(s string) (slog.Level, bool) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, true
+	case "info":
+		return slog.LevelInfo, true
+	case "warn":
+		return slog.LevelWarn, true
+	case "error":
+		return slog.LevelError, true
 	}
+	return 0, false
+}
 
-	logMsg := "Calling ListObjectVersions API"
-	if keyMarker != nil {
-		logMsg += fmt.Sprintf(":keyMarker=%s", *keyMarker)
+// newLogger creates a logger writing to w in the given format, from the given level.
+// In JSON format, each event is a JSON object with its time under the "timestamp" key.
+func newLogger(w io.Writer, format string, level slog.Level) *slog.Logger {
+	if format == logFormatJSON {
+		return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{
+			Level: level,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if len(groups) == 0 && a.Key == slog.TimeKey {
+					a.Key = "timestamp"
+				}
+				return a
+			},
+		}))
 	}
-	if versionIdMarker != nil {
-		logMsg += fmt.Sprintf(":versionIdMarker=%s", *versionIdMarker)
+	return slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: level}))
+}
+
+// readList reads newline-delimited entries such as bucket names, skipping blank lines and lines starting with '#'.
+func readList(r io.Reader) ([]string, error) {
+	var entries []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
 	}
-	log.Printf(logMsg)
+	return entries, nil
+}
 
-	out, err := c.s3API.ListObjectVersionsWithContext(ctx, &input)
+// applyConfigFile sets the flags of fs that weren't passed on the command line from the config file at path.
+// Files ending with ".json" hold a JSON object and the others a YAML mapping, of scalars and lists of scalars.
+// Keys are flag names, or their camelCase form, and lists are joined with commas, as -shard-prefixes takes them.
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]string
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		values, err = parseJSONConfig(b)
+	} else {
+		values, err = parseYAMLConfig(b)
+	}
 	if err != nil {
-		return nil, nil, nil, nil, fmt.Errorf("ListObjectVersions API error: %w", err)
+		return err
 	}
-	log.Printf("Retrieved %d versions and %d deleteMarkers from s3://%s", len(out.Versions), len(out.DeleteMarkers), bucket)
 
-	if len(out.Versions) > 0 {
-		versions = make([]*object, len(out.Versions))
-		for i, v := range out.Versions {
-			versions[i] = &object{
-				Key:       *v.Key,
-				VersionId: *v.VersionId,
+	passed := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { passed[f.Name] = true })
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name := flagName(key)
+		if fs.Lookup(name) == nil || name == optConfig {
+			return fmt.Errorf("unknown option %q", key)
+		}
+		if passed[name] {
+			continue
+		}
+		if err := fs.Set(name, values[key]); err != nil {
+			return fmt.Errorf("invalid value %q for %q: %w", values[key], key, err)
+		}
+	}
+	return nil
+}
+
+// parseJSONConfig parses a JSON config file into the string values of its flags.
+func parseJSONConfig(b []byte) (map[string]string, error) {
+	var raw map[string]any
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+	return configValues(raw)
+}
+
+// parseYAMLConfig parses a YAML config file into the string values of its flags.
+func parseYAMLConfig(b []byte) (map[string]string, error) {
+	var raw map[string]any
+	if err := yaml.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+	return configValues(raw)
+}
+
+// configValues turns the options of a config file into the string values of their flags.
+// Options must be scalars or lists of scalars, which are joined with commas.
+func configValues(raw map[string]any) (map[string]string, error) {
+	values := make(map[string]string, len(raw))
+	for key, v := range raw {
+		if list, ok := v.([]any); ok {
+			items := make([]string, len(list))
+			for i, item := range list {
+				s, ok := configScalar(item)
+				if !ok {
+					return nil, fmt.Errorf("%q: lists must hold scalars, got %v", key, item)
+				}
+				items[i] = s
 			}
+			values[key] = strings.Join(items, ",")
+			continue
+		}
+		s, ok := configScalar(v)
+		if !ok {
+			return nil, fmt.Errorf("%q: unsupported value %v", key, v)
 		}
+		values[key] = s
 	}
+	return values, nil
+}
+
+// configScalar formats a scalar of a config file as a flag value. It reports false for anything else, including null.
+func configScalar(v any) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case int:
+		return strconv.Itoa(v), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	}
+	return "", false
+}
 
-	if len(out.DeleteMarkers) > 0 {
-		deleteMarkers = make([]*object, len(out.DeleteMarkers))
-		for i, d := range out.DeleteMarkers {
-			deleteMarkers[i] = &object{
-				Key:       *d.Key,
-				VersionId: *d.VersionId,
+// flagName maps a config file key to the name of its flag, turning camelCase into kebab-case, e.g., maxKeys into max-keys
+// and roleARN into role-arn. Keys already in kebab-case are kept.
+func flagName(key string) string {
+	runes := []rune(key)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			prevLower := i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]))
+			nextLower := i > 0 && i+1 < len(runes) && unicode.IsUpper(runes[i-1]) && unicode.IsLower(runes[i+1])
+			if prevLower || nextLower {
+				b.WriteByte('-')
 			}
+			r = unicode.ToLower(r)
 		}
+		b.WriteRune(r)
 	}
+	return b.String()
+}
 
-	return versions, deleteMarkers, out.NextKeyMarker, out.NextVersionIdMarker, nil
+// empty reports whether the bucket had nothing to delete within the prefix and the filters, as opposed to a run that deleted nothing because it failed.
+func (r *result) empty() bool {
+	return r.err == nil && !r.StopAtReached && r.DeletedVersions == 0 && r.DeletedDeleteMarkers == 0 && r.FailedObjects == 0 && r.AbortedUploads == 0
 }
 
-func (c *s3cli) deleteObjects(ctx context.Context, bucket string, objects []*object) error {
-	ids := make([]*s3.ObjectIdentifier, len(objects))
-	for i, o := range objects {
-		ids[i] = &s3.ObjectIdentifier{
-			Key:       aws.String(o.Key),
-			VersionId: aws.String(o.VersionId),
+// newSummary creates the machine-readable result of a bucket.
+func newSummary(dryRun, listOnly bool, r *result) *summary {
+	s := &summary{
+		DeletedVersions:      r.DeletedVersions,
+		DeletedDeleteMarkers: r.DeletedDeleteMarkers,
+		BytesFreed:           r.FreedBytes,
+		AbortedUploads:       r.AbortedUploads,
+		FailedObjects:        r.FailedObjects,
+		Bucket:               r.bucket,
+		DryRun:               dryRun,
+		ListOnly:             listOnly,
+		BucketDeleted:        r.bucketDeleted,
+		MaxDeletesReached:    r.MaxDeletesReached,
+		MaxRuntimeReached:    r.StopAtReached,
+		CorrelationID:        r.correlationID,
+		Diff:                 r.diff,
+		Remaining:            r.remaining,
+		Empty:                r.empty(),
+		Prefixes:             r.Prefixes,
+	}
+	if r.err != nil {
+		s.Error = r.err.Error()
+	}
+	return s
+}
+
+// newRunSummary creates the content of -summary-file out of the results of the buckets and the metrics of the run.
+func newRunSummary(correlationID string, dryRun, listOnly bool, results []*result, m *metricsReport) *runSummary {
+	s := &runSummary{CorrelationID: correlationID, ElapsedSeconds: m.ElapsedSeconds, Buckets: make([]*summary, len(results)), Metrics: m}
+	for i, r := range results {
+		s.Buckets[i] = newSummary(dryRun, listOnly, r)
+		s.DeletedVersions += r.DeletedVersions
+		s.DeletedDeleteMarkers += r.DeletedDeleteMarkers
+		s.BytesFreed += r.FreedBytes
+		s.FailedObjects += r.FailedObjects
+		if r.err != nil {
+			s.FailedBuckets++
 		}
 	}
-	input := s3.DeleteObjectsInput{
-		Bucket: aws.String(bucket),
-		Delete: &s3.Delete{
-			Objects: ids,
-		},
+	return s
+}
+
+// writeSummary writes the summary of the run as JSON to the file at path.
+func writeSummary(path string, s *runSummary) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(b, '\n'), 0o644)
+}
+
+// printResult writes the summary of a bucket's cleanup in the given output format.
+func printResult(w io.Writer, output string, dryRun, listOnly bool, r *result) error {
+	if output == outputJSON {
+		return json.NewEncoder(w).Encode(newSummary(dryRun, listOnly, r))
 	}
 
-	log.Printf("Calling DeleteObjects API with %d objects", len(objects))
-	_, err := c.s3API.DeleteObjectsWithContext(ctx, &input)
+	if listOnly {
+		if _, err := fmt.Fprintf(w, "Listed %d versions of objects (%s) and %d object delete markers in s3://%s\n", r.DeletedVersions, formatBytes(r.FreedBytes), r.DeletedDeleteMarkers, r.bucket); err != nil {
+			return err
+		}
+		if r.diff != nil {
+			if _, err := fmt.Fprintf(w, "Since -%s: %d versions and delete markers added and %d removed in s3://%s\n", optDiffManifest, r.diff.Added, r.diff.Removed, r.bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if r.FailedObjects > 0 {
+		if _, err := fmt.Fprintf(w, "Failed to delete %d versions and delete markers in s3://%s\n", r.FailedObjects, r.bucket); err != nil {
+			return err
+		}
+	}
+
+	if r.MaxDeletesReached {
+		if _, err := fmt.Fprintf(w, "Stopped at the -%s cap in s3://%s\n", optMaxDeletes, r.bucket); err != nil {
+			return err
+		}
+	}
+
+	if r.StopAtReached {
+		if _, err := fmt.Fprintf(w, "Stopped due to -%s in s3://%s\n", optMaxRuntime, r.bucket); err != nil {
+			return err
+		}
+	}
+
+	if r.AbortedUploads > 0 {
+		verb := "Aborted"
+		if dryRun {
+			verb = "Would abort"
+		}
+		if _, err := fmt.Fprintf(w, "%s %d incomplete multipart uploads in s3://%s\n", verb, r.AbortedUploads, r.bucket); err != nil {
+			return err
+		}
+	}
+
+	if len(r.Prefixes) > 0 {
+		if err := printPrefixStats(w, r.Prefixes); err != nil {
+			return err
+		}
+	}
+
+	// an empty bucket may still be verified and deleted, so the lines below follow.
+	if r.empty() {
+		if _, err := fmt.Fprintf(w, "Bucket s3://%s is already empty (within scope)\n", r.bucket); err != nil {
+			return err
+		}
+	} else if dryRun {
+		_, err := fmt.Fprintf(w, "Would purge %d versions of objects and %d object delete markers from s3://%s, freeing %s\n", r.DeletedVersions, r.DeletedDeleteMarkers, r.bucket, formatBytes(r.FreedBytes))
+		return err
+	} else if r.err != nil {
+		_, err := fmt.Fprintf(w, "Purged %d versions of objects and %d object delete makers from s3://%s before failing, freeing %s\n", r.DeletedVersions, r.DeletedDeleteMarkers, r.bucket, formatBytes(r.FreedBytes))
+		return err
+	} else if _, err := fmt.Fprintf(w, "Purged %d versions of objects and %d object delete makers from s3://%s, freeing %s\n", r.DeletedVersions, r.DeletedDeleteMarkers, r.bucket, formatBytes(r.FreedBytes)); err != nil {
+		return err
+	}
+	if r.remaining != nil {
+		if _, err := fmt.Fprintf(w, "Verified: %d versions and delete markers remain in s3://%s\n", *r.remaining, r.bucket); err != nil {
+			return err
+		}
+	}
+	if r.bucketDeleted {
+		_, err := fmt.Fprintf(w, "Deleted the bucket s3://%s\n", r.bucket)
+		return err
+	}
+	return nil
+}
+
+// update shows the progress of the deletion.
+func (b *progressBar) update(r cleanup.Result) {
+	deleted := r.DeletedVersions + r.DeletedDeleteMarkers
+	percent := 100.0
+	if b.total > 0 {
+		percent = min(100, float64(deleted)*100/float64(b.total))
+	}
+
+	if b.tty {
+		filled := int(percent / 100 * progressBarWidth)
+		_, _ = fmt.Fprintf(b.w, "\r[%s%s] %5.1f%% %d/%d", strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled), percent, deleted, b.total)
+		return
+	}
+
+	if now := time.Now(); now.Sub(b.last) >= b.interval || deleted >= b.total {
+		b.last = now
+		b.logger.Info("Progress", "percent", fmt.Sprintf("%.1f", percent), "deleted", deleted, "total", b.total)
+	}
+}
+
+// finish ends the progress bar line on a terminal.
+func (b *progressBar) finish() {
+	if b.tty {
+		_, _ = fmt.Fprintln(b.w)
+	}
+}
+
+// newMetricsReport summarizes the API metrics and the deleted objects of all buckets.
+func newMetricsReport(metrics *cleanup.Metrics, results []*result, elapsed time.Duration) *metricsReport {
+	m := &metricsReport{ElapsedSeconds: elapsed.Seconds(), APIs: map[string]apiMetrics{}}
+	for _, r := range results {
+		m.DeletedObjects += r.DeletedVersions + r.DeletedDeleteMarkers
+	}
+	for _, a := range metrics.APIs() {
+		m.APIs[a.API] = apiMetrics{Calls: a.Calls, Seconds: a.Duration.Seconds()}
+	}
+	return m
+}
+
+// printMetrics writes the metrics as a human-readable block.
+func printMetrics(w io.Writer, m *metricsReport) {
+	_, _ = fmt.Fprintln(w, "Metrics:")
+	apis := make([]string, 0, len(m.APIs))
+	for api := range m.APIs {
+		apis = append(apis, api)
+	}
+	sort.Strings(apis)
+	for _, api := range apis {
+		a := m.APIs[api]
+		_, _ = fmt.Fprintf(w, "  %s: %d calls, %.3fs total\n", api, a.Calls, a.Seconds)
+	}
+	_, _ = fmt.Fprintf(w, "  Objects deleted: %d\n", m.DeletedObjects)
+	_, _ = fmt.Fprintf(w, "  Elapsed: %.3fs\n", m.ElapsedSeconds)
+}
+
+// writeMetrics writes the metrics as JSON to the file at path.
+func writeMetrics(path string, m *metricsReport) error {
+	b, err := json.MarshalIndent(m, "", "  ")
 	if err != nil {
-		return fmt.Errorf("DeleteObjects API error: %w", err)
+		return err
 	}
+	return os.WriteFile(path, append(b, '\n'), 0o644)
+}
+
+// publishCloudWatch publishes the DeletedVersions, DeletedDeleteMarkers, and BytesFreed metrics of each bucket, dimensioned by bucket,
+// to the namespace. It runs on its own deadline, so that the metrics of a timed out or interrupted run are still published.
+func publishCloudWatch(cw *cloudwatch.Client, namespace string, results []*result) error {
+	ctx, cancel := context.WithTimeout(context.Background(), cloudWatchTimeout)
+	defer cancel()
 
+	now := time.Now()
+	var data []cwtypes.MetricDatum
+	for _, r := range results {
+		dimensions := []cwtypes.Dimension{{Name: aws.String("Bucket"), Value: aws.String(r.bucket)}}
+		data = append(data,
+			cwtypes.MetricDatum{MetricName: aws.String("DeletedVersions"), Dimensions: dimensions, Timestamp: &now, Unit: cwtypes.StandardUnitCount, Value: aws.Float64(float64(r.DeletedVersions))},
+			cwtypes.MetricDatum{MetricName: aws.String("DeletedDeleteMarkers"), Dimensions: dimensions, Timestamp: &now, Unit: cwtypes.StandardUnitCount, Value: aws.Float64(float64(r.DeletedDeleteMarkers))},
+			cwtypes.MetricDatum{MetricName: aws.String("BytesFreed"), Dimensions: dimensions, Timestamp: &now, Unit: cwtypes.StandardUnitBytes, Value: aws.Float64(float64(r.FreedBytes))},
+		)
+	}
+	for start := 0; start < len(data); start += maxMetricData {
+		end := min(start+maxMetricData, len(data))
+		if _, err := cw.PutMetricData(ctx, &cloudwatch.PutMetricDataInput{Namespace: aws.String(namespace), MetricData: data[start:end]}); err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// printPrefixStats prints the -object-prefix-stats table of a bucket, the keys without a slash being under "(root)".
+func printPrefixStats(w io.Writer, prefixes []cleanup.PrefixStats) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	if _, err := fmt.Fprintln(tw, "PREFIX\tVERSIONS\tDELETE MARKERS\tBYTES"); err != nil {
+		return err
+	}
+	for _, p := range prefixes {
+		prefix := p.Prefix
+		if prefix == "" {
+			prefix = "(root)"
+		}
+		if _, err := fmt.Fprintf(tw, "%s\t%d\t%d\t%s\n", prefix, p.Versions, p.DeleteMarkers, formatBytes(p.Bytes)); err != nil {
+			return err
+		}
+	}
+	return tw.Flush()
+}
+
+// formatBytes formats n bytes in binary units, e.g., "1.5 GiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 4; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTP"[exp])
+}
+
+type (
+	// result is the outcome of cleaning up a bucket.
+	result struct {
+		*cleanup.Result
+
+		bucket        string
+		bucketDeleted bool
+		correlationID string
+		// remaining is the number of versions and delete markers listed again with -verify when set.
+		remaining *int
+		// diff compares the listing with -diff-manifest when set.
+		diff *diffResult
+		err  error
+	}
+
+	// manifestDiff holds the entries of the -diff-manifest manifest, to compare the listings of the buckets with.
+	// It's safe for concurrent use, as buckets may be listed in parallel.
+	manifestDiff struct {
+		mu sync.Mutex
+		// previous tells whether each entry has been listed again.
+		previous map[manifestKey]bool
+	}
+
+	manifestKey struct {
+		bucket       string
+		key          string
+		versionId    string
+		deleteMarker bool
+	}
+
+	// diffResult counts the versions and delete markers added and removed since -diff-manifest.
+	diffResult struct {
+		Added   int `json:"added"`
+		Removed int `json:"removed"`
+	}
+
+	// manifestOutput is a manifest file being written.
+	manifestOutput struct {
+		*cleanup.ManifestWriter
+
+		mu  sync.Mutex
+		f   *os.File
+		gz  *gzip.Writer
+		buf *bufio.Writer
+		// err is the first error of write.
+		err error
+	}
+
+	// eventStream writes the -stream-events lines to stdout.
+	eventStream struct {
+		mu     sync.Mutex
+		enc    *json.Encoder
+		dryRun bool
+		logger *slog.Logger
+		// failed tells that a write failed, which is only logged once.
+		failed bool
+	}
+
+	// event is a line of -stream-events.
+	event struct {
+		Event      string `json:"event"`
+		Bucket     string `json:"bucket"`
+		Count      int    `json:"count"`
+		Type       string `json:"type"`
+		Cumulative int    `json:"cumulative"`
+		DryRun     bool   `json:"dryRun,omitempty"`
+	}
+
+	// progressBar shows the percentage of the versions and delete markers deleted out of the total counted by -count-first.
+	// On a terminal, it's redrawn in place; otherwise, the percentage is logged at most once per interval.
+	progressBar struct {
+		w        io.Writer
+		tty      bool
+		logger   *slog.Logger
+		total    int
+		interval time.Duration
+		last     time.Time
+	}
+
+	// metricsReport is the content of -metrics-file.
+	metricsReport struct {
+		ElapsedSeconds float64               `json:"elapsedSeconds"`
+		DeletedObjects int                   `json:"deletedObjects"`
+		APIs           map[string]apiMetrics `json:"apis"`
+	}
+
+	apiMetrics struct {
+		Calls   int64   `json:"calls"`
+		Seconds float64 `json:"seconds"`
+	}
+
+	// runSummary is the content of -summary-file.
+	runSummary struct {
+		CorrelationID        string         `json:"correlationId,omitempty"`
+		ElapsedSeconds       float64        `json:"elapsedSeconds"`
+		DeletedVersions      int            `json:"deletedVersions"`
+		DeletedDeleteMarkers int            `json:"deletedDeleteMarkers"`
+		BytesFreed           int64          `json:"bytesFreed"`
+		FailedObjects        int            `json:"failedObjects,omitempty"`
+		FailedBuckets        int            `json:"failedBuckets,omitempty"`
+		Buckets              []*summary     `json:"buckets"`
+		Metrics              *metricsReport `json:"metrics"`
+	}
+
+	// summary is the machine-readable result printed with -output json; one line per bucket.
+	summary struct {
+		DeletedVersions      int                   `json:"deletedVersions"`
+		DeletedDeleteMarkers int                   `json:"deletedDeleteMarkers"`
+		BytesFreed           int64                 `json:"bytesFreed"`
+		AbortedUploads       int                   `json:"abortedUploads,omitempty"`
+		FailedObjects        int                   `json:"failedObjects,omitempty"`
+		Bucket               string                `json:"bucket"`
+		DryRun               bool                  `json:"dryRun,omitempty"`
+		ListOnly             bool                  `json:"listOnly,omitempty"`
+		BucketDeleted        bool                  `json:"bucketDeleted,omitempty"`
+		MaxDeletesReached    bool                  `json:"maxDeletesReached,omitempty"`
+		MaxRuntimeReached    bool                  `json:"maxRuntimeReached,omitempty"`
+		CorrelationID        string                `json:"correlationId,omitempty"`
+		Diff                 *diffResult           `json:"diff,omitempty"`
+		Remaining            *int                  `json:"remaining,omitempty"`
+		Empty                bool                  `json:"empty,omitempty"`
+		Prefixes             []cleanup.PrefixStats `json:"prefixes,omitempty"`
+		Error                string                `json:"error,omitempty"`
+	}
+)
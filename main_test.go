@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/bananaumai/s3-cleanup-objects/pkg/cleanup"
+)
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		parse   func([]byte) (map[string]string, error)
+		in      string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name:  "yaml",
+			parse: parseYAMLConfig,
+			in: `# production.yaml
+region: eu-west-1
+prefix: "logs/ # not a comment"
+maxKeys: 1000
+dryRun: true
+olderThan: 2160h # 90 days
+tagFilter: 'owner=bob''s'
+shardPrefixes: [0, 1, a, "b"]
+`,
+			want: map[string]string{
+				"region":        "eu-west-1",
+				"prefix":        "logs/ # not a comment",
+				"maxKeys":       "1000",
+				"dryRun":        "true",
+				"olderThan":     "2160h",
+				"tagFilter":     "owner=bob's",
+				"shardPrefixes": "0,1,a,b",
+			},
+		},
+		{
+			name:  "yaml block list",
+			parse: parseYAMLConfig,
+			in:    "shard-prefixes:\n  - a\n  - b\n",
+			want:  map[string]string{"shard-prefixes": "a,b"},
+		},
+		{
+			name:  "empty yaml",
+			parse: parseYAMLConfig,
+			in:    "# nothing yet\n",
+			want:  map[string]string{},
+		},
+		{name: "yaml nested mapping", parse: parseYAMLConfig, in: "retry:\n  attempts: 3\n", wantErr: true},
+		{name: "yaml null", parse: parseYAMLConfig, in: "prefix:\n", wantErr: true},
+		{name: "yaml list of lists", parse: parseYAMLConfig, in: "shardPrefixes: [[a]]\n", wantErr: true},
+		{name: "yaml not a mapping", parse: parseYAMLConfig, in: "- a\n- b\n", wantErr: true},
+		{name: "invalid yaml", parse: parseYAMLConfig, in: "prefix: \"logs/\n", wantErr: true},
+		{
+			name:  "json",
+			parse: parseJSONConfig,
+			in:    `{"region": "eu-west-1", "maxKeys": 1000, "dryRun": true, "shardPrefixes": ["a", "b"]}`,
+			want:  map[string]string{"region": "eu-west-1", "maxKeys": "1000", "dryRun": "true", "shardPrefixes": "a,b"},
+		},
+		{name: "json nested object", parse: parseJSONConfig, in: `{"retry": {"attempts": 3}}`, wantErr: true},
+		{name: "json null", parse: parseJSONConfig, in: `{"prefix": null}`, wantErr: true},
+		{name: "invalid json", parse: parseJSONConfig, in: `{"prefix": "logs/"`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.parse([]byte(tt.in))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parse() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFlagName(t *testing.T) {
+	for key, want := range map[string]string{
+		"prefix":             "prefix",
+		"maxKeys":            "max-keys",
+		"max-keys":           "max-keys",
+		"roleARN":            "role-arn",
+		"s3SignatureVersion": "s3-signature-version",
+		"startVersionId":     "start-version-id",
+		"olderThan":          "older-than",
+		"MFA":                "mfa",
+		"otlpEndpoint":       "otlp-endpoint",
+	} {
+		if got := flagName(key); got != want {
+			t.Errorf("flagName(%q) = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		in   string
+		// args are passed on the command line, taking precedence over the file.
+		args    []string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name: "yaml",
+			file: "config.yaml",
+			in:   "maxKeys: 500\nregion: eu-west-1\nolder-than: 24h\ndryRun: true\n",
+			want: map[string]string{"max-keys": "500", "region": "eu-west-1", "older-than": "24h0m0s", "dry-run": "true"},
+		},
+		{
+			name: "json",
+			file: "config.JSON",
+			in:   `{"maxKeys": 500, "dryRun": true}`,
+			want: map[string]string{"max-keys": "500", "region": "", "older-than": "0s", "dry-run": "true"},
+		},
+		{
+			name: "command line precedence",
+			file: "config.yaml",
+			in:   "maxKeys: 500\nregion: eu-west-1\n",
+			args: []string{"-max-keys", "10"},
+			want: map[string]string{"max-keys": "10", "region": "eu-west-1", "older-than": "0s", "dry-run": "false"},
+		},
+		{name: "unknown key", file: "config.yaml", in: "maxKey: 500\n", wantErr: `unknown option "maxKey"`},
+		{name: "config key", file: "config.yaml", in: "config: other.yaml\n", wantErr: `unknown option "config"`},
+		{name: "bad number", file: "config.yaml", in: "maxKeys: many\n", wantErr: `invalid value "many" for "maxKeys"`},
+		{name: "bad duration", file: "config.json", in: `{"olderThan": 90}`, wantErr: `invalid value "90" for "olderThan"`},
+		{name: "bad bool", file: "config.yaml", in: "dryRun: maybe\n", wantErr: `invalid value "maybe" for "dryRun"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.in), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			fs.Int("max-keys", 1000, "")
+			fs.String("region", "", "")
+			fs.Duration("older-than", 0, "")
+			fs.Bool("dry-run", false, "")
+			fs.String(optConfig, "", "")
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+
+			err := applyConfigFile(fs, path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("applyConfigFile() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]string)
+			fs.VisitAll(func(f *flag.Flag) {
+				if f.Name != optConfig {
+					got[f.Name] = f.Value.String()
+				}
+			})
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("flags = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateBucketName(t *testing.T) {
+	tests := []struct {
+		name    string
+		bucket  string
+		wantErr bool
+	}{
+		{name: "letters", bucket: "my-bucket"},
+		{name: "digits", bucket: "123"},
+		{name: "dots", bucket: "logs.example.com"},
+		{name: "shortest", bucket: "abc"},
+		{name: "longest", bucket: strings.Repeat("a", 63)},
+		{name: "xn in the middle", bucket: "my-xn--bucket"},
+		{name: "s3alias in the middle", bucket: "my-s3alias-bucket"},
+		{name: "IP-like with more parts", bucket: "192.168.5.4.1"},
+		{name: "too short", bucket: "ab", wantErr: true},
+		{name: "too long", bucket: strings.Repeat("a", 64), wantErr: true},
+		{name: "empty", bucket: "", wantErr: true},
+		{name: "uppercase", bucket: "My-Bucket", wantErr: true},
+		{name: "underscore", bucket: "my_bucket", wantErr: true},
+		{name: "starts with a hyphen", bucket: "-bucket", wantErr: true},
+		{name: "ends with a dot", bucket: "bucket.", wantErr: true},
+		{name: "adjacent dots", bucket: "my..bucket", wantErr: true},
+		{name: "IP address", bucket: "192.168.5.4", wantErr: true},
+		{name: "xn-- prefix", bucket: "xn--bucket", wantErr: true},
+		{name: "sthree- prefix", bucket: "sthree-bucket", wantErr: true},
+		{name: "-s3alias suffix", bucket: "bucket-s3alias", wantErr: true},
+		{name: "--ol-s3 suffix", bucket: "bucket--ol-s3", wantErr: true},
+		{name: "s3:// URL", bucket: "s3://bucket", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateBucketName(tt.bucket); (err != nil) != tt.wantErr {
+				t.Errorf("validateBucketName(%q) error = %v, wantErr %v", tt.bucket, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// validOptions returns the options of the flag defaults, which validate accepts.
+func validOptions() options {
+	return options{
+		maxKeys:          defaultMaxKeys,
+		output:           defaultOutput,
+		signatureVersion: defaultS3SignatureVersion,
+		deleteBatchSize:  defaultDeleteBatchSize,
+		workers:          defaultWorkers,
+		logFormat:        defaultLogFormat,
+		sampleRate:       defaultSampleRate,
+		parallelBuckets:  defaultParallelBuckets,
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(o *options)
+		// wantErr is a substring of the error, none if empty.
+		wantErr string
+		check   func(t *testing.T, o *options)
+	}{
+		{name: "defaults", modify: func(o *options) {}},
+		{name: "max keys too small", modify: func(o *options) { o.maxKeys = 0 }, wantErr: "-max-keys must be between 1 and 1000, got 0"},
+		{name: "max keys too large", modify: func(o *options) { o.maxKeys = 1001 }, wantErr: "-max-keys must be between 1 and 1000"},
+		{name: "delete batch size too large", modify: func(o *options) { o.deleteBatchSize = 1001 }, wantErr: "-delete-batch-size must be between 1 and 1000"},
+		{name: "no workers", modify: func(o *options) { o.workers = 0 }, wantErr: "-workers must be at least 1"},
+		{name: "unknown output", modify: func(o *options) { o.output = "yaml" }, wantErr: `-output must be text or json, got "yaml"`},
+		{name: "SigV2", modify: func(o *options) { o.signatureVersion = "s3" }, wantErr: "only signs requests with Signature Version 4"},
+		{name: "AWS CLI SigV4 name", modify: func(o *options) { o.signatureVersion = "s3v4" }},
+		{name: "bad since", modify: func(o *options) { o.since = "yesterday" }, wantErr: "invalid -since time"},
+		{
+			name:    "since after until",
+			modify:  func(o *options) { o.since, o.until = "2024-02-01T00:00:00Z", "2024-01-01T00:00:00Z" },
+			wantErr: "-since must be before -until",
+		},
+		{
+			name:   "since and until parsed",
+			modify: func(o *options) { o.since, o.until = "2024-01-01T00:00:00Z", "2024-02-01T00:00:00Z" },
+			check: func(t *testing.T, o *options) {
+				if want := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC); !o.sinceTime.Equal(want) {
+					t.Errorf("sinceTime = %v, want %v", o.sinceTime, want)
+				}
+				if want := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC); !o.untilTime.Equal(want) {
+					t.Errorf("untilTime = %v, want %v", o.untilTime, want)
+				}
+			},
+		},
+		{name: "bad include", modify: func(o *options) { o.include = "(" }, wantErr: "invalid -include regular expression"},
+		{name: "bucket pattern without yes", modify: func(o *options) { o.bucketPattern = "^tmp-" }, wantErr: "-list-buckets-matching requires -yes"},
+		{name: "bucket pattern in a dry run", modify: func(o *options) { o.bucketPattern, o.dryRun = "^tmp-", true }},
+		{name: "list only without output file", modify: func(o *options) { o.listOnly = true }, wantErr: "-list-only requires -output-file"},
+		{name: "output file without list only", modify: func(o *options) { o.outputFile = "out.csv" }, wantErr: "-output-file is only valid with -list-only"},
+		{
+			name: "retry the error manifest being written",
+			modify: func(o *options) {
+				o.continueOnError, o.retryFailed, o.errorManifestFile = true, "failed.csv", "failed.csv"
+			},
+			wantErr: "-retry-failed and -error-manifest must be different files",
+		},
+		{name: "start version without start after", modify: func(o *options) { o.startVersionId = "v1" }, wantErr: "-start-version-id requires -start-after"},
+		{name: "markers last with a checkpoint", modify: func(o *options) { o.markersLast, o.checkpointFile = true, "cp.json" }, wantErr: "-markers-last can't be used with -checkpoint-file"},
+		{name: "sample rate of 0", modify: func(o *options) { o.sampleRate = 0 }, wantErr: "-sample-rate must be greater than 0 and at most 1"},
+		{
+			name:   "shard prefixes parsed",
+			modify: func(o *options) { o.shardPrefixes = "a, b,,c" },
+			check: func(t *testing.T, o *options) {
+				if want := []string{"a", "b", "c"}; !reflect.DeepEqual(o.shards, want) {
+					t.Errorf("shards = %v, want %v", o.shards, want)
+				}
+			},
+		},
+		{name: "bad tag filter", modify: func(o *options) { o.tagFilter = "owner" }, wantErr: "invalid -tag-filter"},
+		{name: "bad bucket owner", modify: func(o *options) { o.bucketOwner = "12345" }, wantErr: "-expected-bucket-owner must be a 12-digit AWS account ID"},
+		{name: "parallel buckets with max deletes", modify: func(o *options) { o.parallelBuckets, o.maxDeletes = 2, 10 }, wantErr: "-parallel-buckets can't be used with -max-deletes"},
+		{name: "verify a dry run", modify: func(o *options) { o.verify, o.dryRun = true, true }, wantErr: "-verify can't be used with -dry-run"},
+		{name: "bad log level", modify: func(o *options) { o.logLevel = "verbose" }, wantErr: `-log-level must be debug, info, warn, or error, got "verbose"`},
+		{name: "log objects at error level", modify: func(o *options) { o.logObjects, o.logLevel = true, "error" }, wantErr: "-log-objects requires -log-level debug or info"},
+		{
+			// an explicit -log-level wins over -quiet.
+			name:   "log level with quiet",
+			modify: func(o *options) { o.logLevel, o.quiet = "warn", true },
+			check: func(t *testing.T, o *options) {
+				if o.level != slog.LevelWarn {
+					t.Errorf("level = %v, want %v", o.level, slog.LevelWarn)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := validOptions()
+			tt.modify(&o)
+			err := o.validate()
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("validate() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("validate() error = %v, want %q", err, tt.wantErr)
+			}
+			if tt.check != nil {
+				tt.check(t, &o)
+			}
+		})
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	remaining := func(n int) *int { return &n }
+
+	tests := []struct {
+		name        string
+		ctx         context.Context
+		r           *result
+		failOnEmpty int
+		want        int
+	}{
+		{name: "success", r: &result{Result: &cleanup.Result{DeletedVersions: 1}}, want: exitOK},
+		{name: "nothing to delete", r: &result{Result: &cleanup.Result{}}, want: exitOK},
+		{name: "nothing to delete with -fail-on-empty", r: &result{Result: &cleanup.Result{}}, failOnEmpty: 10, want: 10},
+		{name: "deleted with -fail-on-empty", r: &result{Result: &cleanup.Result{DeletedVersions: 1}}, failOnEmpty: 10, want: exitOK},
+		{name: "not confirmed", r: &result{Result: &cleanup.Result{}, err: fmt.Errorf("s3://test: %w", errNotConfirmed)}, want: exitUsage},
+		{name: "unsupported inventory", r: &result{Result: &cleanup.Result{}, err: cleanup.ErrUnsupportedInventoryFormat}, want: exitUsage},
+		{name: "wrong region", r: &result{Result: &cleanup.Result{}, err: fmt.Errorf("head: %w", cleanup.ErrWrongRegion)}, want: exitConfig},
+		{name: "MFA required", r: &result{Result: &cleanup.Result{}, err: cleanup.ErrMFARequired}, want: exitConfig},
+		{
+			name: "expired credentials",
+			r:    &result{Result: &cleanup.Result{}, err: fmt.Errorf("list: %w", &smithy.GenericAPIError{Code: "ExpiredToken"})},
+			want: exitConfig,
+		},
+		{name: "failed objects", r: &result{Result: &cleanup.Result{DeletedVersions: 1, FailedObjects: 2}, err: errors.New("failed to delete 2 objects")}, want: exitPartialFailure},
+		{name: "objects not deleted", r: &result{Result: &cleanup.Result{}, err: fmt.Errorf("delete: %w", cleanup.ErrObjectsNotDeleted)}, want: exitPartialFailure},
+		{name: "interrupted", ctx: canceled, r: &result{Result: &cleanup.Result{}, err: context.Canceled}, want: exitInterrupted},
+		// a bucket done before the interruption succeeded.
+		{name: "success before the interruption", ctx: canceled, r: &result{Result: &cleanup.Result{DeletedVersions: 1}}, want: exitOK},
+		{name: "remaining after -verify", r: &result{Result: &cleanup.Result{DeletedVersions: 1}, remaining: remaining(3)}, want: exitRemaining},
+		{name: "nothing remaining after -verify", r: &result{Result: &cleanup.Result{DeletedVersions: 1}, remaining: remaining(0)}, want: exitOK},
+		{name: "other error", r: &result{Result: &cleanup.Result{}, err: errors.New("connection reset")}, want: exitError},
+		{name: "other API error", r: &result{Result: &cleanup.Result{}, err: &smithy.GenericAPIError{Code: "InternalError"}}, want: exitError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := tt.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+			if got := exitCode(ctx, tt.r, tt.failOnEmpty); got != tt.want {
+				t.Errorf("exitCode() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package cleanup
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type (
+	// checkpoint is the position in the listing up to which every version and delete marker has been deleted.
+	checkpoint struct {
+		Bucket          string  `json:"bucket"`
+		KeyMarker       *string `json:"keyMarker"`
+		VersionIdMarker *string `json:"versionIdMarker"`
+	}
+
+	// checkpointer records a checkpoint each time the deletion of the oldest pending page completes.
+	// Pages are deleted out of order by the workers, so a page only counts once all the pages listed before it are deleted.
+	checkpointer struct {
+		mu     sync.Mutex
+		path   string
+		bucket string
+		logger *slog.Logger
+		// pending holds the dispatched pages that aren't deleted yet, in listing order.
+		pending []*pendingPage
+	}
+
+	pendingPage struct {
+		number    int
+		remaining int
+		failed    bool
+		// keyMarker and versionIdMarker are where the listing continues after the page.
+		keyMarker       *string
+		versionIdMarker *string
+	}
+)
+
+// loadCheckpoint reads the checkpoint at path. It returns nil without an error if the file doesn't exist.
+func loadCheckpoint(path string) (*checkpoint, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+// saveCheckpoint writes the checkpoint to path through a temporary file, so that a crash never leaves a truncated file.
+func saveCheckpoint(path string, cp *checkpoint) error {
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// add registers a page that is about to be dispatched in the given number of batches.
+func (c *checkpointer) add(p *page, batches int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pending = append(c.pending, &pendingPage{
+		number:          p.number,
+		remaining:       batches,
+		keyMarker:       p.nextKeyMarker,
+		versionIdMarker: p.nextVersionIdMarker,
+	})
+}
+
+// done records that a batch of the page has been processed, and saves a checkpoint if the oldest pending pages are now deleted.
+// A page with a failed batch is never checkpointed.
+func (c *checkpointer) done(number int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, p := range c.pending {
+		if p.number == number {
+			p.remaining--
+			p.failed = p.failed || err != nil
+			break
+		}
+	}
+
+	var last *pendingPage
+	for len(c.pending) > 0 && c.pending[0].remaining == 0 && !c.pending[0].failed {
+		last, c.pending = c.pending[0], c.pending[1:]
+	}
+	if last == nil {
+		return
+	}
+
+	cp := &checkpoint{Bucket: c.bucket, KeyMarker: last.keyMarker, VersionIdMarker: last.versionIdMarker}
+	if err := saveCheckpoint(c.path, cp); err != nil {
+		c.logger.Warn("Failed to save the checkpoint", "page", last.number, "error", err)
+	}
+}
@@ -0,0 +1,106 @@
+package cleanup
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestCleanupCheckpoint(t *testing.T) {
+	errList := errors.New("list failed")
+	pages := []fakePage{
+		{versions: testObjects("a", 1, 0)},
+		{versions: testObjects("b", 1, 0)},
+		{versions: testObjects("c", 1, 0)},
+	}
+	// at returns the checkpoint of bucket "test" continuing at the page of the given index.
+	at := func(page string) *checkpoint {
+		return &checkpoint{Bucket: "test", KeyMarker: aws.String(page), VersionIdMarker: aws.String("next")}
+	}
+
+	tests := []struct {
+		name string
+		// checkpoint is saved before the cleanup when set.
+		checkpoint *checkpoint
+		listErr    error
+		errPage    int
+		failKeys   map[string]string
+
+		wantErr         error
+		wantListMarkers [][2]string
+		// wantDeleteCalls is left unchecked when nil.
+		wantDeleteCalls [][]string
+		// wantCheckpoint is the checkpoint left after the cleanup, nil for none.
+		wantCheckpoint *checkpoint
+	}{
+		{
+			name:            "resume",
+			checkpoint:      at("2"),
+			wantListMarkers: [][2]string{{"2", "next"}},
+			wantDeleteCalls: [][]string{{"c1"}},
+		},
+		{
+			name:            "checkpoint of another bucket",
+			checkpoint:      &checkpoint{Bucket: "other", KeyMarker: aws.String("2"), VersionIdMarker: aws.String("next")},
+			wantListMarkers: [][2]string{{"", ""}, {"1", "next"}, {"2", "next"}},
+			wantDeleteCalls: [][]string{{"a1"}, {"b1"}, {"c1"}},
+		},
+		{
+			// the pages listed before the failure are deleted, so the next run resumes at the failed one.
+			name:            "list error",
+			listErr:         errList,
+			errPage:         2,
+			wantErr:         errList,
+			wantListMarkers: [][2]string{{"", ""}, {"1", "next"}, {"2", "next"}},
+			wantDeleteCalls: [][]string{{"a1"}, {"b1"}},
+			wantCheckpoint:  at("2"),
+		},
+		{
+			// the page after the failed one may still be deleted, but the checkpoint never moves past a failed page.
+			name:           "delete error",
+			failKeys:       map[string]string{"b1": "AccessDenied"},
+			wantErr:        ErrObjectsNotDeleted,
+			wantCheckpoint: at("1"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "checkpoint.json")
+			if tt.checkpoint != nil {
+				if err := saveCheckpoint(path, tt.checkpoint); err != nil {
+					t.Fatal(err)
+				}
+			}
+			f := &fakeS3Client{pages: pages, listErr: tt.listErr, listErrPage: tt.errPage, failKeys: tt.failKeys}
+			// a single worker, so that the pages are deleted in listing order.
+			c := newTestCleaner(t, f, Config{CheckpointFile: path, Workers: 1})
+
+			_, err := c.Cleanup(context.Background())
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("Cleanup() error = %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Cleanup() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantListMarkers != nil && !reflect.DeepEqual(f.listMarkers, tt.wantListMarkers) {
+				t.Errorf("ListObjectVersions markers = %v, want %v", f.listMarkers, tt.wantListMarkers)
+			}
+			if tt.wantDeleteCalls != nil && !reflect.DeepEqual(f.deleteCalls, tt.wantDeleteCalls) {
+				t.Errorf("DeleteObjects calls = %v, want %v", f.deleteCalls, tt.wantDeleteCalls)
+			}
+
+			cp, err := loadCheckpoint(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(cp, tt.wantCheckpoint) {
+				t.Errorf("checkpoint = %+v, want %+v", cp, tt.wantCheckpoint)
+			}
+		})
+	}
+}
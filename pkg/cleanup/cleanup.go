@@ -0,0 +1,1619 @@
+// Package cleanup deletes all versions and delete markers of objects in an S3 bucket.
+package cleanup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math/rand"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/time/rate"
+)
+
+const defaultMaxKeys = 1000
+
+// MinMaxKeys and MaxMaxKeys bound Config.MaxKeys, as the ListObjectVersions API does.
+const MinMaxKeys = 1
+const MaxMaxKeys = 1000
+
+// MinDeleteBatchSize and MaxDeleteBatchSize bound Config.DeleteBatchSize, up to what a single DeleteObjects call accepts.
+const MinDeleteBatchSize = 1
+const MaxDeleteBatchSize = maxDeleteObjects
+
+// rampMaxKeys is the max-keys of the first ListObjectVersions call with RampPaging.
+const rampMaxKeys = 100
+
+// pageBufferSize is the number of listed pages that can wait for deletion.
+const pageBufferSize = 1
+
+// maxDeleteObjects is the maximum number of keys a single DeleteObjects API call accepts.
+const maxDeleteObjects = 1000
+
+// Config configures a Cleaner. Zero values fall back to sensible defaults where noted.
+type Config struct {
+	// Bucket is the name of the bucket to clean up. It's required.
+	Bucket string
+	// MaxKeys is the max-keys parameter for the ListObjectVersions API, 1-1000. Defaults to 1000.
+	MaxKeys int64
+	// Prefix limits the listing to the keys starting with it when set.
+	Prefix string
+	// Delimiter, when set, limits the listing to the keys that don't contain it after Prefix, i.e., a single "directory" level.
+	// The keys rolled up into common prefixes are logged and kept.
+	Delimiter string
+	// ShardPrefixes, when set, splits the listing into one concurrent listing per Prefix+shard prefix, e.g., "0" to "9" and "a" to "f"
+	// for keys starting with a hex digit. The keys outside the shard prefixes aren't listed, so they're kept.
+	// It only speeds up the listing if the keys are reasonably distributed across the shard prefixes.
+	// The shard prefixes must not be prefixes of one another, and it can't be used with CheckpointFile.
+	ShardPrefixes []string
+	// StartAfter, when set, starts the listing after this key, e.g., to split a huge bucket into key ranges across runs.
+	// StartVersionId additionally starts it after this version of the StartAfter key rather than after all of its versions.
+	// A checkpoint of CheckpointFile for the bucket takes precedence. They don't apply to CleanupManifest.
+	StartAfter     string
+	StartVersionId string
+	// RampPaging starts listing with a small max-keys parameter and doubles it on each page up to MaxKeys,
+	// so that the first deletions start sooner.
+	RampPaging bool
+	// DryRun lists the versions and delete markers that would be deleted without deleting them.
+	DryRun bool
+	// Workers is the number of DeleteObjects batches to run in parallel. Defaults to 1.
+	Workers int
+	// DeleteBatchSize is the maximum number of keys of each DeleteObjects call, 1-1000. Defaults to 1000.
+	// Smaller batches fail and are retried with fewer objects, at the cost of more calls.
+	DeleteBatchSize int
+	// MaxRetries is the maximum number of retries for throttled or failed API calls.
+	MaxRetries int
+	// APITimeout, when nonzero, bounds each API call attempt, so that a stuck connection fails quickly and is retried
+	// instead of using up the deadline of the context.
+	APITimeout time.Duration
+	// DeleteLimiter throttles DeleteObjects calls when set. It can be shared among Cleaners.
+	DeleteLimiter *rate.Limiter
+	// Metrics records the number of API calls and the time spent in them when set. It can be shared among Cleaners.
+	Metrics *Metrics
+
+	// BypassGovernance sets BypassGovernanceRetention on DeleteObjects calls.
+	BypassGovernance bool
+	// MFA is the "<serial> <token>" value sent with DeleteObjects calls for buckets with MFA Delete enabled.
+	MFA string
+	// RequesterPays acknowledges that the requester pays for the calls to a requester-pays bucket, which fail without it.
+	RequesterPays bool
+	// ExpectedBucketOwner, when set, is the ID of the account the bucket must belong to, so that a bucket re-created
+	// by another account isn't cleaned up. S3 rejects the calls otherwise, which fail with ErrAccessDenied.
+	ExpectedBucketOwner string
+
+	// OlderThan excludes objects modified more recently than this from deletion when nonzero.
+	OlderThan time.Duration
+	// Since and Until, when nonzero, only delete the objects last modified in [Since, Until).
+	Since time.Time
+	Until time.Time
+	// Include and Exclude match object keys to delete and to keep respectively when set.
+	// Exclude takes precedence over Include.
+	Include *regexp.Regexp
+	Exclude *regexp.Regexp
+	// KeepLatest keeps the current version of each key, which may be a delete marker, and deletes only the older ones.
+	KeepLatest bool
+	// CurrentOnly only deletes the current version of each key, by key rather than by version ID, so that S3 hides it behind a new delete marker
+	// and the version history is kept for later recovery. Delete markers are left alone, and nothing is freed.
+	// DeletedVersions counts the hidden versions. It can't be used with KeepLatest or KeepVersions.
+	CurrentOnly bool
+	// VersionsOnly only deletes versions and leaves the delete markers alone, and MarkersOnly the other way around,
+	// e.g., to undelete the objects hidden by delete markers without purging their versions. They're mutually exclusive,
+	// and MarkersOnly can't be used with CurrentOnly.
+	VersionsOnly bool
+	MarkersOnly  bool
+	// MarkersLast holds back the delete markers until all the versions are deleted, so that deleting the delete marker of a key
+	// never makes an older version of it current again, even for a moment, in a filtered run. The delete markers are kept in memory
+	// meanwhile, and they're left alone if the listing doesn't complete, e.g., on a failure or at MaxDeletes, or, with ContinueOnError,
+	// for the keys whose versions failed to be deleted. It can't be used with CheckpointFile.
+	MarkersLast bool
+	// KeepVersions, when nonzero, keeps the newest KeepVersions versions and delete markers of each key by LastModified.
+	// The versions of a key are buffered in memory until the listing moves on to the next key, so a key with millions of versions
+	// costs memory in proportion. It applies to the listing only, not to CleanupManifest, and can't be used with CheckpointFile.
+	KeepVersions int
+	// TagFilter, when set, only deletes the versions whose tags match it. Delete markers have no tags and aren't affected.
+	// It costs a GetObjectTagging call per version.
+	TagFilter *TagFilter
+	// CommandFilter, when set, lets an external command select the versions and delete markers to delete out of the ones
+	// that pass the other filters. A failure of the command fails the cleanup.
+	CommandFilter *CommandFilter
+	// SampleRate, when between 0 and 1 exclusive, deletes each matching version or delete marker with this probability,
+	// e.g., to try out the cleanup on a fraction of a bucket. Zero and 1 delete them all.
+	SampleRate float64
+	// ContinueOnError keeps going after a failed DeleteObjects batch instead of stopping the cleanup.
+	// The failures are logged and reported through OnFailure, and the returned error sums them up at the end.
+	ContinueOnError bool
+	// IgnoreNotFound treats the versions and delete markers that DeleteObjects reports as NoSuchKey or NoSuchVersion as deleted
+	// rather than failed, since they're gone either way, e.g., deleted by a concurrent cleanup since they were listed.
+	IgnoreNotFound bool
+	// OnFailure, when set, is called for each version or delete marker that failed to be deleted with ContinueOnError.
+	// Calls are serialized.
+	OnFailure func(*ManifestEntry, error)
+	// AbortMultipart makes Cleanup also abort the incomplete multipart uploads of the bucket once its versions and delete markers are deleted.
+	// Only Prefix, ShardPrefixes, and the age filters, OlderThan, Since, and Until, against the initiation time, apply to the uploads;
+	// the key filters, KeepLatest, SampleRate, DenyList, and Delimiter don't.
+	AbortMultipart bool
+	// DenyList holds keys and key prefixes that are never deleted, whatever the other filters say.
+	DenyList []string
+	// MaxDeletes, when nonzero, caps the number of versions and delete markers a cleanup deletes, as a safety net against misconfigured filters.
+	// Once it's reached, the page at hand is truncated to fit, the listing stops, and Result.MaxDeletesReached is set; it isn't an error.
+	// The checkpoint, if any, is kept so that the next run resumes from there.
+	MaxDeletes int
+	// StopAt, when set, stops a cleanup gracefully at that time, e.g., at the end of a maintenance window: the listing stops,
+	// the in-flight DeleteObjects calls complete, the queued batches are dropped, and Result.StopAtReached is set; it isn't an error.
+	// Unlike the deadline of the context, the Result is then complete and the checkpoint, if any, is kept.
+	StopAt time.Time
+
+	// ProgressInterval enables periodic progress logging when nonzero.
+	ProgressInterval time.Duration
+	// LogObjects logs each deleted version and delete marker with its key and version ID, e.g., for audit trails,
+	// in addition to the counts of each DeleteObjects batch.
+	LogObjects bool
+	// PrefixStats makes Cleanup, CleanupManifest, and RetryFailed break the deleted versions and delete markers down
+	// by top-level prefix in Result.Prefixes.
+	PrefixStats bool
+	// ListRetention makes List record the Object Lock retention and legal hold of each version in its manifest entries,
+	// so that the versions that can't be deleted yet are known upfront. It costs a GetObjectRetention and a GetObjectLegalHold call
+	// per version, only made if the bucket has Object Lock enabled.
+	ListRetention bool
+	// Tracer, when set, traces Cleanup, CleanupManifest, RetryFailed, and List, with a child span for each ListObjectVersions
+	// and DeleteObjects call. Without it, no span is created.
+	Tracer trace.Tracer
+	// OnPage, when set, is called by Cleanup and CleanupManifest with the versions and delete markers of each page
+	// that are about to be deleted, after filtering. Returning an error stops the cleanup before the page is deleted.
+	// Calls are serialized, and the slices must not be modified.
+	OnPage func(versions, deleteMarkers []*Object) error
+	// OnProgress, when set, is called with the cumulative counts after each DeleteObjects batch.
+	// Calls are serialized, so it doesn't need to be safe for concurrent use, but it should return quickly.
+	OnProgress func(Result)
+	// OnBatch, when set, is called after each DeleteObjects batch with whether it held delete markers, the number of objects it deleted,
+	// and the cumulative counts. Calls are serialized along with OnProgress.
+	OnBatch func(deleteMarkers bool, deleted int, total Result)
+
+	// CheckpointFile, when set, is where Cleanup records how far the listing has been deleted after each page,
+	// and where it resumes from if the file exists for the same bucket. It's removed once the cleanup completes.
+	// It's ignored in dry-run mode.
+	CheckpointFile string
+
+	// Logger defaults to slog.Default().
+	Logger *slog.Logger
+}
+
+// New creates a Cleaner that cleans up cfg.Bucket through api.
+func New(api S3API, cfg Config) (*Cleaner, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("bucket is required")
+	}
+	if cfg.MaxKeys == 0 {
+		cfg.MaxKeys = defaultMaxKeys
+	}
+	if cfg.MaxKeys < MinMaxKeys || cfg.MaxKeys > MaxMaxKeys {
+		return nil, fmt.Errorf("max keys must be between %d and %d, got %d", MinMaxKeys, MaxMaxKeys, cfg.MaxKeys)
+	}
+	if cfg.Workers == 0 {
+		cfg.Workers = 1
+	}
+	if cfg.DeleteBatchSize == 0 {
+		cfg.DeleteBatchSize = maxDeleteObjects
+	}
+	if cfg.DeleteBatchSize < MinDeleteBatchSize || cfg.DeleteBatchSize > MaxDeleteBatchSize {
+		return nil, fmt.Errorf("delete batch size must be between %d and %d, got %d", MinDeleteBatchSize, MaxDeleteBatchSize, cfg.DeleteBatchSize)
+	}
+	if cfg.Workers < 0 {
+		return nil, fmt.Errorf("workers must not be negative, got %d", cfg.Workers)
+	}
+	if cfg.MaxRetries < 0 {
+		return nil, fmt.Errorf("max retries must not be negative, got %d", cfg.MaxRetries)
+	}
+	if cfg.APITimeout < 0 {
+		return nil, fmt.Errorf("API timeout must not be negative, got %s", cfg.APITimeout)
+	}
+	if cfg.OlderThan < 0 {
+		return nil, fmt.Errorf("older than must not be negative, got %s", cfg.OlderThan)
+	}
+	if !cfg.Since.IsZero() && !cfg.Until.IsZero() && !cfg.Since.Before(cfg.Until) {
+		return nil, fmt.Errorf("since must be before until, got %s and %s", cfg.Since.Format(time.RFC3339), cfg.Until.Format(time.RFC3339))
+	}
+	if cfg.SampleRate < 0 || cfg.SampleRate > 1 {
+		return nil, fmt.Errorf("sample rate must be between 0 and 1, got %g", cfg.SampleRate)
+	}
+	if cfg.KeepVersions < 0 {
+		return nil, fmt.Errorf("keep versions must not be negative, got %d", cfg.KeepVersions)
+	}
+	if cfg.CurrentOnly && (cfg.KeepLatest || cfg.KeepVersions > 0) {
+		return nil, errors.New("current only can't be used with keep latest or keep versions")
+	}
+	if cfg.VersionsOnly && cfg.MarkersOnly {
+		return nil, errors.New("versions only and markers only are mutually exclusive")
+	}
+	if cfg.MarkersOnly && cfg.CurrentOnly {
+		return nil, errors.New("markers only can't be used with current only")
+	}
+	// a page is only checkpointed once its delete markers are deleted, which markers last postpones to the end of the run.
+	if cfg.MarkersLast && cfg.CheckpointFile != "" {
+		return nil, errors.New("markers last can't be used with a checkpoint file")
+	}
+	// a checkpoint taken while the versions of a key are held back would skip them on resumption.
+	if cfg.KeepVersions > 0 && cfg.CheckpointFile != "" {
+		return nil, errors.New("keep versions can't be used with a checkpoint file")
+	}
+	for i, a := range cfg.ShardPrefixes {
+		if a == "" {
+			return nil, errors.New("shard prefixes must not be empty")
+		}
+		for _, b := range cfg.ShardPrefixes[i+1:] {
+			if strings.HasPrefix(a, b) || strings.HasPrefix(b, a) {
+				return nil, fmt.Errorf("shard prefixes must not overlap, got %q and %q", a, b)
+			}
+		}
+	}
+	// a single pair of markers can't tell how far each of the shards has been deleted.
+	if len(cfg.ShardPrefixes) > 0 && cfg.CheckpointFile != "" {
+		return nil, errors.New("shard prefixes can't be used with a checkpoint file")
+	}
+	if cfg.StartVersionId != "" && cfg.StartAfter == "" {
+		return nil, errors.New("start version ID requires start after")
+	}
+	if cfg.CommandFilter != nil && strings.TrimSpace(cfg.CommandFilter.Command) == "" {
+		return nil, errors.New("command filter must have a command")
+	}
+	if cfg.MaxDeletes < 0 {
+		return nil, fmt.Errorf("max deletes must not be negative, got %d", cfg.MaxDeletes)
+	}
+	if cfg.ProgressInterval < 0 {
+		return nil, fmt.Errorf("progress interval must not be negative, got %s", cfg.ProgressInterval)
+	}
+
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	logger = logger.With("bucket", cfg.Bucket)
+
+	return &Cleaner{
+		s3Client: newS3cli(api, cfg, logger),
+		bucket:   cfg.Bucket,
+		prefix:   cfg.Prefix,
+		shards:   cfg.ShardPrefixes,
+
+		startAfter:     cfg.StartAfter,
+		startVersionId: cfg.StartVersionId,
+
+		maxKeys: cfg.MaxKeys,
+		ramp:    cfg.RampPaging,
+		dryRun:  cfg.DryRun,
+		workers: cfg.Workers,
+
+		deleteBatchSize: cfg.DeleteBatchSize,
+
+		olderThan: cfg.OlderThan,
+		now:       time.Now,
+		since:     cfg.Since,
+		until:     cfg.Until,
+		include:   cfg.Include,
+		exclude:   cfg.Exclude,
+
+		keepLatest:    cfg.KeepLatest,
+		currentOnly:   cfg.CurrentOnly,
+		versionsOnly:  cfg.VersionsOnly,
+		markersOnly:   cfg.MarkersOnly,
+		markersLast:   cfg.MarkersLast,
+		keepVersions:  cfg.KeepVersions,
+		denyList:      cfg.DenyList,
+		tagFilter:     cfg.TagFilter,
+		commandFilter: cfg.CommandFilter,
+		sampleRate:    cfg.SampleRate,
+
+		abortMultipart: cfg.AbortMultipart,
+		maxDeletes:     cfg.MaxDeletes,
+		stopAt:         cfg.StopAt,
+
+		continueOnError: cfg.ContinueOnError,
+		onFailure:       cfg.OnFailure,
+
+		progressInterval: cfg.ProgressInterval,
+		logObjects:       cfg.LogObjects,
+		prefixStats:      cfg.PrefixStats,
+		listRetention:    cfg.ListRetention,
+		tracer:           cfg.Tracer,
+		onPage:           cfg.OnPage,
+		onProgress:       cfg.OnProgress,
+		onBatch:          cfg.OnBatch,
+		checkpointFile:   cfg.CheckpointFile,
+
+		logger: logger,
+	}, nil
+}
+
+// ListBuckets returns the names of the buckets of the account that match pattern, or all of them if it's nil.
+// Only cfg.MaxRetries, cfg.Metrics, and cfg.Logger apply; cfg.Bucket isn't required.
+// The buckets of all regions are listed, so some of them may be in another region than the client's.
+func ListBuckets(ctx context.Context, api S3API, cfg Config, pattern *regexp.Regexp) ([]string, error) {
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if id := CorrelationID(ctx); id != "" {
+		logger = logger.With("correlationId", id)
+	}
+
+	var client s3Client = newS3cli(api, cfg, logger)
+	names, err := client.listBuckets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if pattern == nil {
+		return names, nil
+	}
+	var matched []string
+	for _, name := range names {
+		if pattern.MatchString(name) {
+			matched = append(matched, name)
+		}
+	}
+	return matched, nil
+}
+
+// BucketRegion returns the region of cfg.Bucket as reported by S3, whether or not it's the client's region,
+// e.g., to build a client for the region of the bucket before calling New.
+// Only cfg.Bucket, cfg.MaxRetries, cfg.APITimeout, cfg.ExpectedBucketOwner, cfg.Metrics, and cfg.Logger apply.
+func BucketRegion(ctx context.Context, api S3API, cfg Config) (string, error) {
+	if cfg.Bucket == "" {
+		return "", errors.New("bucket is required")
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if id := CorrelationID(ctx); id != "" {
+		logger = logger.With("correlationId", id)
+	}
+
+	var client s3Client = newS3cli(api, cfg, logger.With("bucket", cfg.Bucket))
+	region, err := client.headBucket(ctx, cfg.Bucket)
+	var wrongRegion *WrongRegionError
+	if errors.As(err, &wrongRegion) {
+		return wrongRegion.Region, nil
+	}
+	return region, err
+}
+
+// Cleanup deletes the versions and delete markers of the bucket.
+// On failure, the returned Result still reports what was deleted before the failure.
+//
+// Canceling ctx stops the cleanup once the in-flight DeleteObjects calls complete, so that the Result stays accurate.
+// The deadline of ctx, if any, still applies to those calls.
+func (c *Cleaner) Cleanup(ctx context.Context) (r *Result, err error) {
+	c = c.withCorrelationID(ctx)
+	ctx, span := c.startSpan(ctx, "Cleanup", c.spanAttributes)
+	defer func() { endResultSpan(span, r, err) }()
+	if err := c.preflight(ctx); err != nil {
+		return &Result{}, err
+	}
+	r, err = c.cleanup(ctx)
+	if err == nil && ctx.Err() == nil && c.abortMultipart && !r.MaxDeletesReached && !r.StopAtReached {
+		r.AbortedUploads, err = c.abortUploads(ctx)
+	}
+	return r, err
+}
+
+// CleanupManifest deletes the versions and delete markers listed in the manifest instead of listing the bucket.
+// Entries for other buckets are skipped, and entries without a version ID are rejected.
+// Filters still apply, and the Result and cancellation behave as with Cleanup.
+func (c *Cleaner) CleanupManifest(ctx context.Context, r *ManifestReader) (result *Result, err error) {
+	c = c.withCorrelationID(ctx)
+	ctx, span := c.startSpan(ctx, "CleanupManifest", c.spanAttributes)
+	defer func() { endResultSpan(span, result, err) }()
+	if err := c.preflight(ctx); err != nil {
+		return &Result{}, err
+	}
+	return c.run(ctx, c.readPages(r, true), nil)
+}
+
+// RetryFailed deletes the versions and delete markers listed in a manifest as they are, e.g., the failures reported through OnFailure
+// by an earlier run with ContinueOnError. Unlike CleanupManifest, the filters don't apply, since the entries already matched them.
+// Entries for other buckets are skipped, and entries without a version ID are rejected.
+func (c *Cleaner) RetryFailed(ctx context.Context, r *ManifestReader) (result *Result, err error) {
+	c = c.withCorrelationID(ctx)
+	ctx, span := c.startSpan(ctx, "RetryFailed", c.spanAttributes)
+	defer func() { endResultSpan(span, result, err) }()
+	if err := c.preflight(ctx); err != nil {
+		return &Result{}, err
+	}
+	return c.run(ctx, c.readPages(r, false), nil)
+}
+
+// Count counts the versions and delete markers of the bucket that Cleanup would delete, without deleting anything.
+// Without filters that need to look at each version or delete marker, the pages are counted as they're listed,
+// without allocating their objects.
+func (c *Cleaner) Count(ctx context.Context) (result *Result, err error) {
+	if !c.countable() {
+		return c.List(ctx, func(*ManifestEntry) error { return nil })
+	}
+
+	c = c.withCorrelationID(ctx)
+	ctx, span := c.startSpan(ctx, "Count", nil)
+	defer func() { endResultSpan(span, result, err) }()
+	if err := c.preflight(ctx); err != nil {
+		return &Result{}, err
+	}
+
+	var (
+		mu sync.Mutex
+		r  Result
+	)
+	keyMarker, versionIdMarker := c.startMarkers()
+	err = c.eachShard(ctx, func(ctx context.Context, prefix string) error {
+		return c.countPages(ctx, prefix, keyMarker, versionIdMarker, func(counts objectCounts) {
+			mu.Lock()
+			defer mu.Unlock()
+			if !c.markersOnly {
+				r.DeletedVersions += counts.versions
+				r.FreedBytes += counts.bytes
+			}
+			if !c.versionsOnly {
+				r.DeletedDeleteMarkers += counts.deleteMarkers
+			}
+		})
+	})
+	return &r, err
+}
+
+// countable reports whether Count can count the pages without looking at their versions and delete markers.
+func (c *Cleaner) countable() bool {
+	return !c.filtering() && c.keepVersions == 0 && c.tagFilter == nil && c.commandFilter == nil
+}
+
+// List lists the versions and delete markers of the bucket that Cleanup would delete and calls fn for each of them,
+// without deleting anything. An error returned by fn stops the listing.
+// The returned Result counts the listed versions and delete markers, and the total size of the versions.
+func (c *Cleaner) List(ctx context.Context, fn func(*ManifestEntry) error) (result *Result, err error) {
+	c = c.withCorrelationID(ctx)
+	ctx, span := c.startSpan(ctx, "List", nil)
+	defer func() { endResultSpan(span, result, err) }()
+	if err := c.preflight(ctx); err != nil {
+		return &Result{}, err
+	}
+
+	// checked before the listing starts, so that a failure doesn't leave the listing goroutine blocked on a page nobody reads.
+	lockEnabled := false
+	if c.listRetention {
+		if lockEnabled, err = c.getObjectLockEnabled(ctx, c.bucket); err != nil {
+			return &Result{}, fmt.Errorf("failed to get the Object Lock configuration: %w", err)
+		}
+		if !lockEnabled {
+			c.logger.Warn("The bucket doesn't have Object Lock enabled, so no version has a retention or a legal hold")
+		}
+	}
+
+	listCtx, cancelList := context.WithCancel(ctx)
+	defer cancelList()
+
+	pages := make(chan *page, pageBufferSize)
+	listErr := make(chan error, 1)
+	go func() {
+		defer close(pages)
+		listErr <- c.listShards(listCtx, pages)
+	}()
+
+	var r Result
+	emit := func(o *Object, isDeleteMarker bool) error {
+		e := c.manifestEntry(o, isDeleteMarker)
+		// delete markers can't be locked.
+		if lockEnabled && !isDeleteMarker {
+			if err := c.addRetention(ctx, e); err != nil {
+				return err
+			}
+		}
+		return fn(e)
+	}
+
+	// keep draining pages after a failure so that the listing goroutine can exit.
+	for p := range pages {
+		if err != nil {
+			continue
+		}
+		for _, v := range p.versions {
+			if err = emit(v, false); err != nil {
+				break
+			}
+			r.DeletedVersions++
+			r.FreedBytes += v.Size
+		}
+		for _, d := range p.deleteMarkers {
+			if err != nil {
+				break
+			}
+			if err = emit(d, true); err != nil {
+				break
+			}
+			r.DeletedDeleteMarkers++
+		}
+		if err != nil {
+			cancelList()
+		}
+	}
+
+	if lerr := <-listErr; err == nil {
+		err = lerr
+	}
+	return &r, err
+}
+
+// DeleteBucket deletes the bucket, which must be empty, e.g., once Cleanup has deleted all of its versions and delete markers.
+// It checks that no version or delete marker remains first, regardless of the prefix and the filters, and fails with ErrBucketNotEmpty otherwise.
+// In dry-run mode, it only logs that it would delete the bucket.
+func (c *Cleaner) DeleteBucket(ctx context.Context) error {
+	c = c.withCorrelationID(ctx)
+	if c.dryRun {
+		c.logger.Info("Would delete the bucket")
+		return nil
+	}
+
+	key, versionId, found, err := c.firstObjectVersion(ctx, c.bucket)
+	if err != nil {
+		return fmt.Errorf("failed to check that the bucket is empty: %w", err)
+	}
+	if found {
+		return fmt.Errorf("%w: key %q version %q remains", ErrBucketNotEmpty, key, versionId)
+	}
+
+	if err := c.deleteBucket(ctx, c.bucket); err != nil {
+		return fmt.Errorf("failed to delete the bucket: %w", err)
+	}
+	c.logger.Info("Deleted the bucket")
+	return nil
+}
+
+type (
+	// Cleaner deletes versions and delete markers of objects in a bucket.
+	Cleaner struct {
+		s3Client
+
+		bucket string
+		prefix string
+		// shards are appended to prefix to list the bucket concurrently when set.
+		shards []string
+		// startAfter and startVersionId are the markers the listing starts after when set.
+		startAfter     string
+		startVersionId string
+		maxKeys        int64
+		ramp           bool
+		dryRun         bool
+		workers        int
+		// deleteBatchSize is the maximum number of objects of a batch.
+		deleteBatchSize int
+
+		// olderThan excludes objects modified more recently than this from deletion when nonzero.
+		olderThan time.Duration
+		// now is the clock olderThan is measured against, stubbed out by tests.
+		now func() time.Time
+		// since and until only delete objects last modified in [since, until) when nonzero.
+		since time.Time
+		until time.Time
+		// include and exclude match object keys to delete and to keep respectively when set.
+		include *regexp.Regexp
+		exclude *regexp.Regexp
+		// keepLatest keeps the current version of each key.
+		keepLatest bool
+		// currentOnly hides the current version of each key behind a delete marker and keeps everything else.
+		currentOnly bool
+		// versionsOnly and markersOnly restrict the deletion to versions and to delete markers respectively.
+		versionsOnly bool
+		markersOnly  bool
+		// markersLast deletes the delete markers once all the versions are deleted.
+		markersLast bool
+		// keepVersions keeps the newest keepVersions versions of each key when nonzero.
+		keepVersions int
+		// denyList holds keys and key prefixes that are never deleted.
+		denyList []string
+		// tagFilter only deletes the versions whose tags match it when set.
+		tagFilter *TagFilter
+		// commandFilter selects the objects to delete with an external command when set.
+		commandFilter *CommandFilter
+		// sampleRate is the probability to delete each matching object when between 0 and 1 exclusive.
+		sampleRate float64
+
+		// abortMultipart aborts the incomplete multipart uploads after the deletion.
+		abortMultipart bool
+		// maxDeletes caps the number of versions and delete markers to delete when nonzero.
+		maxDeletes int
+		// stopAt stops the cleanup gracefully when nonzero.
+		stopAt time.Time
+
+		// continueOnError keeps going after a failed DeleteObjects batch, reporting the failed objects to onFailure.
+		continueOnError bool
+		onFailure       func(*ManifestEntry, error)
+
+		// progressInterval enables periodic progress logging when nonzero.
+		progressInterval time.Duration
+		// logObjects logs each deleted object.
+		logObjects  bool
+		prefixStats bool
+		// listRetention makes List record the retention and legal hold of each version.
+		listRetention  bool
+		tracer         trace.Tracer
+		onPage         func(versions, deleteMarkers []*Object) error
+		onProgress     func(Result)
+		onBatch        func(deleteMarkers bool, deleted int, total Result)
+		checkpointFile string
+
+		logger *slog.Logger
+	}
+
+	// Result is the outcome of a cleanup.
+	Result struct {
+		DeletedVersions      int
+		DeletedDeleteMarkers int
+		// FreedBytes is the total size of the deleted versions.
+		FreedBytes int64
+		// FailedObjects is the number of versions and delete markers that failed to be deleted with Config.ContinueOnError.
+		FailedObjects int
+		// AbortedUploads is the number of incomplete multipart uploads aborted with Config.AbortMultipart.
+		AbortedUploads int
+		// MaxDeletesReached tells that the cleanup stopped at Config.MaxDeletes, possibly leaving versions and delete markers behind.
+		MaxDeletesReached bool
+		// StopAtReached tells that the cleanup stopped at Config.StopAt, possibly leaving versions and delete markers behind.
+		StopAtReached bool
+		// Prefixes breaks the deleted versions and delete markers down by top-level prefix with Config.PrefixStats,
+		// the largest first.
+		Prefixes []PrefixStats
+	}
+
+	// s3Client is the seam between the cleanup logic and S3, so that the logic can be exercised without S3.
+	s3Client interface {
+		headBucket(ctx context.Context, bucket string) (string, error)
+		deleteBucket(ctx context.Context, bucket string) error
+		listBuckets(ctx context.Context) ([]string, error)
+		listMultipartUploads(ctx context.Context, bucket, prefix string, keyMarker, uploadIdMarker *string) (uploads []*upload, nextKeyMarker, nextUploadIdMarker *string, err error)
+		abortMultipartUpload(ctx context.Context, bucket, key, uploadId string) error
+		getObjectTagging(ctx context.Context, bucket, key, versionId string) (map[string]string, error)
+		// getObject gets the body of an object, which the caller must close.
+		getObject(ctx context.Context, bucket, key string) (io.ReadCloser, error)
+		// getObjectLockEnabled reports whether the bucket has Object Lock enabled.
+		getObjectLockEnabled(ctx context.Context, bucket string) (bool, error)
+		// getObjectRetention returns the retention mode and retain-until date of a version, which are empty if it has no retention.
+		getObjectRetention(ctx context.Context, bucket, key, versionId string) (mode string, retainUntil time.Time, err error)
+		getObjectLegalHold(ctx context.Context, bucket, key, versionId string) (bool, error)
+		// getBucketVersioning returns the versioning status of the bucket, which is empty if versioning has never been enabled.
+		getBucketVersioning(ctx context.Context, bucket string) (string, error)
+		listObjectVersions(ctx context.Context, bucket, prefix string, maxKeys int64, keyMarker, versionIdMarker *string) (versions []*Object, deleteMarkers []*Object, nextKeyMarker, nextVersionIdMarker *string, err error)
+		// firstObjectVersion returns the first version or delete marker of the whole bucket, ignoring the delimiter.
+		firstObjectVersion(ctx context.Context, bucket string) (key, versionId string, found bool, err error)
+		// countObjectVersions counts the page that listObjectVersions would list, without allocating its objects.
+		countObjectVersions(ctx context.Context, bucket, prefix string, maxKeys int64, keyMarker, versionIdMarker *string) (counts objectCounts, nextKeyMarker, nextVersionIdMarker *string, err error)
+		deleteObjects(ctx context.Context, bucket string, objects []*Object) (deleted int, err error)
+	}
+
+	// objectCounts is the number of versions and delete markers of a page, and the total size of the versions.
+	objectCounts struct {
+		versions      int
+		deleteMarkers int
+		bytes         int64
+	}
+
+	page struct {
+		number        int
+		versions      []*Object
+		deleteMarkers []*Object
+		// nextKeyMarker and nextVersionIdMarker are where the listing continues after the page.
+		nextKeyMarker       *string
+		nextVersionIdMarker *string
+		// manifest tells that the page was read from a manifest rather than listed.
+		manifest bool
+	}
+
+	// batch is a unit of work for a deletion worker; it never holds more than deleteBatchSize objects.
+	batch struct {
+		page          int
+		objects       []*Object
+		deleteMarkers bool
+	}
+
+	// Object is a version or a delete marker of an object.
+	Object struct {
+		Key          string
+		VersionId    string
+		LastModified time.Time
+		// Size is always zero for delete markers.
+		Size int64
+		// IsLatest tells whether this is the current version of the object.
+		IsLatest bool
+	}
+
+	// deduper drops the versions and delete markers seen before from the pages of a run, by key and version ID.
+	// The pages of a listing only pass the entries of their greatest key on to the next one, since a listing is sorted
+	// and the versions of a key may continue on the next page; those of a manifest keep them all, since its entries may repeat anywhere.
+	deduper struct {
+		seen map[[2]string]bool
+	}
+)
+
+// preflight checks that the bucket exists in the client's region, and warns if versioning isn't enabled,
+// in which case there are no noncurrent versions to purge.
+// Failing to get the versioning status, e.g., for lack of the s3:GetBucketVersioning permission, only warns too.
+func (c *Cleaner) preflight(ctx context.Context) error {
+	if _, err := c.headBucket(ctx, c.bucket); err != nil {
+		return err
+	}
+
+	status, err := c.getBucketVersioning(ctx, c.bucket)
+	if err != nil {
+		c.logger.Warn("Failed to check the versioning status of the bucket", "error", err)
+		return nil
+	}
+	switch status {
+	case "Enabled":
+	case "Suspended":
+		c.logger.Warn("Versioning is suspended on the bucket; only the versions created before the suspension have version IDs to purge")
+	default:
+		c.logger.Warn("Versioning has never been enabled on the bucket; its objects have a single null version")
+	}
+	return nil
+}
+
+func (c *Cleaner) cleanup(ctx context.Context) (*Result, error) {
+	if c.checkpointFile == "" || c.dryRun {
+		return c.run(ctx, c.listShards, nil)
+	}
+
+	keyMarker, versionIdMarker := c.startMarkers()
+	cp, err := loadCheckpoint(c.checkpointFile)
+	if err != nil {
+		return &Result{}, fmt.Errorf("failed to load the checkpoint: %w", err)
+	}
+	if cp != nil && cp.Bucket == c.bucket {
+		keyMarker, versionIdMarker = cp.KeyMarker, cp.VersionIdMarker
+		c.logger.Info("Resuming from the checkpoint", "keyMarker", aws.ToString(keyMarker), "versionIdMarker", aws.ToString(versionIdMarker))
+	}
+
+	checkpoints := &checkpointer{path: c.checkpointFile, bucket: c.bucket, logger: c.logger}
+	r, err := c.run(ctx, func(ctx context.Context, pages chan<- *page) error {
+		return c.listPages(ctx, pages, c.prefix, keyMarker, versionIdMarker)
+	}, checkpoints)
+
+	// the checkpoint is kept after a failure, an interruption, hitting the cap, or the stop time so that the next run can resume from it.
+	if err == nil && ctx.Err() == nil && !r.MaxDeletesReached && !r.StopAtReached {
+		if rerr := os.Remove(c.checkpointFile); rerr != nil && !errors.Is(rerr, fs.ErrNotExist) {
+			c.logger.Warn("Failed to remove the checkpoint", "error", rerr)
+		}
+	}
+	return r, err
+}
+
+// run deletes the pages sent by source, which is either listPages or a manifest read by readPages.
+// When checkpoints is set, it's notified of the progress of each page.
+func (c *Cleaner) run(ctx context.Context, source func(ctx context.Context, pages chan<- *page) error, checkpoints *checkpointer) (*Result, error) {
+	// listing and deleting are pipelined; the next page is listed while the current one is being deleted
+	// by a pool of workers. deleting the objects of a page doesn't shift the key/version markers,
+	// so the listing can safely run ahead.
+	listCtx, cancelList := context.WithCancel(ctx)
+	defer cancelList()
+
+	pages := make(chan *page, pageBufferSize)
+	listErr := make(chan error, 1)
+	go func() {
+		defer close(pages)
+		listErr <- source(listCtx, pages)
+	}()
+
+	var (
+		wg                sync.WaitGroup
+		mu                sync.Mutex
+		errs              []error
+		versionCount      atomic.Int64
+		deleteMarkerCount atomic.Int64
+		freedByteCount    atomic.Int64
+
+		// with continueOnError, failed batches are counted instead of stopping the run.
+		failedCount   int
+		failedBatches int
+		firstErr      error
+	)
+
+	if c.progressInterval > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go c.reportProgress(ctx, done, &versionCount, &deleteMarkerCount)
+	}
+
+	// in-flight deletions use deleteCtx instead of listCtx so that a failure or a cancellation doesn't abort them halfway;
+	// those stop the listing and the dispatching of further batches instead.
+	deleteCtx, cancelDelete := withoutCancel(ctx)
+	defer cancelDelete()
+
+	// reaching stopAt stops the listing like hitting the cap, and the workers drop the queued batches.
+	var (
+		stopped atomic.Bool
+		timer   *time.Timer
+	)
+	if !c.stopAt.IsZero() {
+		timer = time.AfterFunc(c.stopAt.Sub(c.now()), func() {
+			c.logger.Warn("Reached the stop time, stopping", "stopAt", c.stopAt)
+			stopped.Store(true)
+			cancelList()
+		})
+	}
+
+	var prefixes *prefixCounter
+	if c.prefixStats {
+		prefixes = &prefixCounter{}
+	}
+
+	// failedKeys holds the keys whose versions failed to be deleted with continueOnError, whose delete markers markersLast keeps.
+	failedKeys := make(map[string]bool)
+	worker := func(batches <-chan *batch) {
+		defer wg.Done()
+		for b := range batches {
+			// batches already queued when ctx is canceled or at stopAt are dropped.
+			if ctx.Err() != nil || stopped.Load() {
+				continue
+			}
+
+			var (
+				n   int
+				err error
+			)
+			if b.deleteMarkers {
+				n, err = c.deleteDeleteMarkers(deleteCtx, b.page, b.objects)
+				deleteMarkerCount.Add(int64(n))
+			} else {
+				n, err = c.deleteVersions(deleteCtx, b.page, b.objects)
+				versionCount.Add(int64(n))
+				// hidden versions are still stored.
+				if !c.currentOnly {
+					freedByteCount.Add(deletedSize(b.objects, n, err))
+				}
+			}
+			if prefixes != nil {
+				// hidden versions are still stored, as for FreedBytes.
+				prefixes.add(deletedObjects(b.objects, n, err), b.deleteMarkers, !c.currentOnly)
+			}
+			if checkpoints != nil {
+				checkpoints.done(b.page, err)
+			}
+			if c.onProgress != nil || c.onBatch != nil {
+				mu.Lock()
+				total := Result{
+					DeletedVersions:      int(versionCount.Load()),
+					DeletedDeleteMarkers: int(deleteMarkerCount.Load()),
+					FreedBytes:           freedByteCount.Load(),
+				}
+				if c.onProgress != nil {
+					c.onProgress(total)
+				}
+				if c.onBatch != nil {
+					c.onBatch(b.deleteMarkers, n, total)
+				}
+				mu.Unlock()
+			}
+			if err != nil && c.continueOnError {
+				failed := failedObjects(b.objects, n, err)
+				c.logger.Error("Failed to delete a batch, continuing", "page", b.page, "objects", len(b.objects), "failed", len(failed), "error", err)
+				mu.Lock()
+				failedCount += len(failed)
+				failedBatches++
+				if firstErr == nil {
+					firstErr = err
+				}
+				if c.onFailure != nil {
+					for _, o := range failed {
+						c.onFailure(c.manifestEntry(o, b.deleteMarkers), err)
+					}
+				}
+				if c.markersLast && !b.deleteMarkers {
+					for _, o := range failed {
+						failedKeys[o.Key] = true
+					}
+				}
+				mu.Unlock()
+			} else if err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+				cancelList()
+			}
+		}
+	}
+	startWorkers := func() chan<- *batch {
+		batches := make(chan *batch, c.workers)
+		for i := 0; i < c.workers; i++ {
+			wg.Add(1)
+			go worker(batches)
+		}
+		return batches
+	}
+	batches := startWorkers()
+
+	// keep draining pages after a failure or hitting the cap so that the listing goroutine can exit.
+	var (
+		pageErr    error
+		capped     bool
+		truncated  bool
+		dispatched int
+		dedupe     deduper
+		// with markersLast, the delete marker batches are held back until all the versions are deleted.
+		deferred []*batch
+	)
+	for p := range pages {
+		if pageErr != nil || capped || stopped.Load() {
+			continue
+		}
+		if n := dedupe.dedupe(p); n > 0 {
+			c.logger.Warn("Dropped duplicate versions and delete markers", "page", p.number, "duplicates", n)
+		}
+		if c.maxDeletes > 0 {
+			truncated = p.truncate(c.maxDeletes - dispatched)
+			dispatched += len(p.versions) + len(p.deleteMarkers)
+			capped = dispatched == c.maxDeletes
+		}
+		if c.onPage != nil {
+			if err := c.onPage(p.versions, p.deleteMarkers); err != nil {
+				pageErr = fmt.Errorf("page callback failed on page %d: %w", p.number, err)
+				cancelList()
+				continue
+			}
+		}
+
+		bs := p.batches(c.deleteBatchSize)
+		// the rest of a truncated page isn't deleted, so the checkpoint mustn't move past it.
+		if checkpoints != nil && !truncated {
+			checkpoints.add(p, len(bs))
+		}
+		for _, b := range bs {
+			if c.markersLast && b.deleteMarkers {
+				deferred = append(deferred, b)
+				continue
+			}
+			select {
+			case batches <- b:
+			case <-listCtx.Done():
+			}
+		}
+		if capped {
+			c.logger.Warn("Reached the maximum number of deletions, stopping", "maxDeletes", c.maxDeletes)
+			cancelList()
+		}
+	}
+	close(batches)
+	wg.Wait()
+
+	if pageErr != nil {
+		errs = append(errs, pageErr)
+	}
+	lerr := <-listErr
+
+	if len(deferred) > 0 {
+		var kept int
+		deferred, kept = withoutKeys(deferred, failedKeys)
+		if kept > 0 {
+			c.logger.Warn("Kept the delete markers of keys whose versions failed to be deleted", "deleteMarkers", kept)
+		}
+		// without a complete listing, some versions of the keys may not have been deleted, or even listed.
+		if lerr != nil || capped || stopped.Load() || len(errs) > 0 || ctx.Err() != nil {
+			c.logger.Warn("Kept the delete markers since not all the versions were deleted", "deleteMarkers", countObjects(deferred))
+		} else {
+			c.logger.Info("Deleting the delete markers after the versions", "deleteMarkers", countObjects(deferred))
+			batches = startWorkers()
+			for _, b := range deferred {
+				mu.Lock()
+				failed := len(errs) > 0
+				mu.Unlock()
+				if failed {
+					break
+				}
+				select {
+				case batches <- b:
+				case <-ctx.Done():
+				}
+			}
+			close(batches)
+			wg.Wait()
+		}
+	}
+	if timer != nil {
+		timer.Stop()
+	}
+	reached := stopped.Load()
+
+	// a listing error caused by our own cancellation after a failed deletion, hitting the cap, or the stop time isn't worth reporting.
+	if err := lerr; err != nil && (len(errs) == 0 || ctx.Err() != nil) && (!(capped || reached) || ctx.Err() != nil) {
+		errs = append(errs, err)
+	}
+
+	if firstErr != nil {
+		errs = append(errs, fmt.Errorf("failed to delete %d objects in %d batches, the first failure being: %w", failedCount, failedBatches, firstErr))
+	}
+
+	r := &Result{
+		DeletedVersions:      int(versionCount.Load()),
+		DeletedDeleteMarkers: int(deleteMarkerCount.Load()),
+		FreedBytes:           freedByteCount.Load(),
+		FailedObjects:        failedCount,
+		MaxDeletesReached:    capped,
+		StopAtReached:        reached,
+	}
+	if prefixes != nil {
+		r.Prefixes = prefixes.stats()
+	}
+	return r, errors.Join(errs...)
+}
+
+// withoutKeys removes the objects of the given keys from the batches, returning the remaining batches and the number of removed objects.
+func withoutKeys(bs []*batch, keys map[string]bool) ([]*batch, int) {
+	if len(keys) == 0 {
+		return bs, 0
+	}
+	var (
+		remaining []*batch
+		removed   int
+	)
+	for _, b := range bs {
+		var objects []*Object
+		for _, o := range b.objects {
+			if keys[o.Key] {
+				removed++
+			} else {
+				objects = append(objects, o)
+			}
+		}
+		if len(objects) > 0 {
+			remaining = append(remaining, &batch{page: b.page, objects: objects, deleteMarkers: b.deleteMarkers})
+		}
+	}
+	return remaining, removed
+}
+
+// countObjects returns the number of objects in the batches.
+func countObjects(bs []*batch) int {
+	var n int
+	for _, b := range bs {
+		n += len(b.objects)
+	}
+	return n
+}
+
+// withoutCancel returns a context that isn't canceled along with ctx but still honors its deadline.
+func withoutCancel(ctx context.Context) (context.Context, context.CancelFunc) {
+	detached := context.WithoutCancel(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithDeadline(detached, deadline)
+	}
+	return context.WithCancel(detached)
+}
+
+// deletedSize sums the sizes of the objects that were actually deleted out of the given ones.
+func deletedSize(objects []*Object, n int, err error) int64 {
+	var size int64
+	for _, o := range deletedObjects(objects, n, err) {
+		size += o.Size
+	}
+	return size
+}
+
+// deletedObjects returns the objects that were actually deleted out of the given ones.
+// Without per-object failures, deleteObjects stops at the first failed call, so the first n objects are the deleted ones.
+func deletedObjects(objects []*Object, n int, err error) []*Object {
+	var derr *deleteObjectsError
+	if !errors.As(err, &derr) {
+		return objects[:n]
+	}
+
+	failed := make(map[[2]string]bool, len(derr.failures))
+	for _, f := range derr.failures {
+		failed[[2]string{f.Key, f.VersionId}] = true
+	}
+	var deleted []*Object
+	for _, o := range objects {
+		if !failed[[2]string{o.Key, o.VersionId}] {
+			deleted = append(deleted, o)
+		}
+	}
+	return deleted
+}
+
+// failedObjects returns the objects that failed to be deleted out of the given ones, the counterpart of deletedSize.
+func failedObjects(objects []*Object, n int, err error) []*Object {
+	var derr *deleteObjectsError
+	if errors.As(err, &derr) {
+		failed := make([]*Object, len(derr.failures))
+		for i, f := range derr.failures {
+			failed[i] = f.Object
+		}
+		return failed
+	}
+	return objects[n:]
+}
+
+// manifestEntry converts an object of the bucket to a manifest entry.
+func (c *Cleaner) manifestEntry(o *Object, isDeleteMarker bool) *ManifestEntry {
+	return &ManifestEntry{
+		Bucket:         c.bucket,
+		Key:            o.Key,
+		VersionId:      o.VersionId,
+		IsDeleteMarker: isDeleteMarker,
+		LastModified:   o.LastModified,
+		Size:           o.Size,
+		IsLatest:       o.IsLatest,
+	}
+}
+
+// filterObjects returns the objects that are eligible for deletion.
+func (c *Cleaner) filterObjects(objects []*Object, cutoff time.Time) []*Object {
+	if !c.filtering() {
+		return objects
+	}
+
+	var filtered []*Object
+	for _, o := range objects {
+		if entry, ok := c.denied(o.Key); ok {
+			c.logger.Info("Skipped object protected by the deny list", "key", o.Key, "versionId", o.VersionId, "entry", entry)
+			continue
+		}
+		if c.currentOnly && !o.IsLatest {
+			continue
+		}
+		if c.shouldDelete(o, cutoff) {
+			filtered = append(filtered, o)
+		}
+	}
+	if skipped := len(objects) - len(filtered); skipped > 0 {
+		c.logger.Info("Skipped objects not matching the filters", "skipped", skipped)
+	}
+	return filtered
+}
+
+// filterVersions returns the versions that are eligible for deletion. With markersOnly, none are.
+func (c *Cleaner) filterVersions(versions []*Object, cutoff time.Time) []*Object {
+	if c.markersOnly {
+		return nil
+	}
+	return c.filterObjects(versions, cutoff)
+}
+
+// filterDeleteMarkers returns the delete markers that are eligible for deletion.
+// With currentOnly, none are: a current delete marker already hides its key. With versionsOnly, none are either.
+func (c *Cleaner) filterDeleteMarkers(deleteMarkers []*Object, cutoff time.Time) []*Object {
+	if c.currentOnly || c.versionsOnly {
+		return nil
+	}
+	return c.filterObjects(deleteMarkers, cutoff)
+}
+
+// filtering reports whether any of the filters is set, so that filterObjects can skip checking each object otherwise.
+func (c *Cleaner) filtering() bool {
+	return c.olderThan > 0 || !c.since.IsZero() || !c.until.IsZero() || c.include != nil || c.exclude != nil ||
+		c.keepLatest || c.currentOnly || len(c.denyList) > 0 || (c.sampleRate > 0 && c.sampleRate < 1)
+}
+
+// denied reports whether the key is protected by the deny list, along with the matching entry.
+// An entry protects the key equal to it and all the keys it's a prefix of.
+func (c *Cleaner) denied(key string) (string, bool) {
+	for _, entry := range c.denyList {
+		if strings.HasPrefix(key, entry) {
+			return entry, true
+		}
+	}
+	return "", false
+}
+
+func (c *Cleaner) shouldDelete(o *Object, cutoff time.Time) bool {
+	// each key has exactly one current version across the listing, so it can be told apart without grouping the versions by key.
+	if c.keepLatest && o.IsLatest {
+		return false
+	}
+	if c.olderThan > 0 && o.LastModified.After(cutoff) {
+		return false
+	}
+	if (!c.since.IsZero() && o.LastModified.Before(c.since)) || (!c.until.IsZero() && !o.LastModified.Before(c.until)) {
+		c.logger.Debug("Skipped object outside the time window", "key", o.Key, "versionId", o.VersionId, "lastModified", o.LastModified)
+		return false
+	}
+	if c.exclude != nil && c.exclude.MatchString(o.Key) {
+		return false
+	}
+	if c.include != nil && !c.include.MatchString(o.Key) {
+		return false
+	}
+	// sampling comes last so that the rate applies to the objects matching the other filters.
+	if c.sampleRate > 0 && c.sampleRate < 1 && rand.Float64() >= c.sampleRate {
+		return false
+	}
+	return true
+}
+
+// dedupe drops the versions and delete markers of the page already seen, in the page or in the previous ones as kept by the deduper,
+// keeping the first of each, and returns the number of dropped ones. A listing never repeats them, but a manifest may,
+// e.g., one merging a retry manifest with a fresh listing, and DeleteObjects would then either reject the batch or count them twice.
+func (d *deduper) dedupe(p *page) int {
+	if d.seen == nil {
+		d.seen = make(map[[2]string]bool, len(p.versions)+len(p.deleteMarkers))
+	}
+	unique := func(objects []*Object) []*Object {
+		kept := objects[:0]
+		for _, o := range objects {
+			id := [2]string{o.Key, o.VersionId}
+			if !d.seen[id] {
+				d.seen[id] = true
+				kept = append(kept, o)
+			}
+		}
+		return kept
+	}
+	n := len(p.versions) + len(p.deleteMarkers)
+	p.versions, p.deleteMarkers = unique(p.versions), unique(p.deleteMarkers)
+	if p.manifest {
+		return n - len(p.versions) - len(p.deleteMarkers)
+	}
+
+	var last string
+	for _, objects := range [][]*Object{p.versions, p.deleteMarkers} {
+		for _, o := range objects {
+			last = max(last, o.Key)
+		}
+	}
+	for id := range d.seen {
+		if id[0] != last {
+			delete(d.seen, id)
+		}
+	}
+	return n - len(p.versions) - len(p.deleteMarkers)
+}
+
+// truncate drops the objects of the page beyond the first n, versions first, and reports whether any were dropped.
+func (p *page) truncate(n int) bool {
+	if len(p.versions)+len(p.deleteMarkers) <= n {
+		return false
+	}
+	if len(p.versions) >= n {
+		p.versions, p.deleteMarkers = p.versions[:n], nil
+	} else {
+		p.deleteMarkers = p.deleteMarkers[:n-len(p.versions)]
+	}
+	return true
+}
+
+// batches splits the page into batches of up to size versions followed by batches of up to size delete markers.
+func (p *page) batches(size int) []*batch {
+	var batches []*batch
+	for _, objects := range chunk(p.versions, size) {
+		batches = append(batches, &batch{page: p.number, objects: objects})
+	}
+	for _, objects := range chunk(p.deleteMarkers, size) {
+		batches = append(batches, &batch{page: p.number, objects: objects, deleteMarkers: true})
+	}
+	return batches
+}
+
+func chunk(objects []*Object, size int) [][]*Object {
+	var chunks [][]*Object
+	for start := 0; start < len(objects); start += size {
+		end := start + size
+		if end > len(objects) {
+			end = len(objects)
+		}
+		chunks = append(chunks, objects[start:end])
+	}
+	return chunks
+}
+
+// reportProgress logs the cumulative deleted counts every progressInterval until done is closed or ctx is canceled.
+func (c *Cleaner) reportProgress(ctx context.Context, done <-chan struct{}, versionCount, deleteMarkerCount *atomic.Int64) {
+	start := time.Now()
+	ticker := time.NewTicker(c.progressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			versions, deleteMarkers := versionCount.Load(), deleteMarkerCount.Load()
+			elapsed := time.Since(start)
+			rate := float64(versions+deleteMarkers) / elapsed.Seconds()
+			c.logger.Info("Progress", "deletedVersions", versions, "deletedDeleteMarkers", deleteMarkers, "elapsed", elapsed.Round(time.Second), "objectsPerSecond", fmt.Sprintf("%.1f", rate))
+		}
+	}
+}
+
+// listShards lists the versions and delete markers of the bucket, concurrently across the shard prefixes if set,
+// and sends them page by page. The pages of the shards are interleaved, each shard numbering its own.
+func (c *Cleaner) listShards(ctx context.Context, pages chan<- *page) error {
+	keyMarker, versionIdMarker := c.startMarkers()
+	return c.eachShard(ctx, func(ctx context.Context, prefix string) error {
+		return c.listPages(ctx, pages, prefix, keyMarker, versionIdMarker)
+	})
+}
+
+// eachShard calls fn with the prefix, or concurrently with each of the shard prefixes if set.
+// A failing shard cancels the others.
+func (c *Cleaner) eachShard(ctx context.Context, fn func(ctx context.Context, prefix string) error) error {
+	if len(c.shards) == 0 {
+		return fn(ctx, c.prefix)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, len(c.shards))
+	)
+	for i, shard := range c.shards {
+		wg.Add(1)
+		go func(i int, prefix string) {
+			defer wg.Done()
+			if err := fn(ctx, prefix); err != nil {
+				errs[i] = fmt.Errorf("shard %q: %w", prefix, err)
+				// the other shards can't be deleted without this one failing the cleanup anyway.
+				cancel()
+			}
+		}(i, c.prefix+shard)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// startMarkers returns the markers the listing starts after, which are nil unless startAfter is set.
+func (c *Cleaner) startMarkers() (keyMarker, versionIdMarker *string) {
+	if c.startAfter == "" {
+		return nil, nil
+	}
+	if c.startVersionId != "" {
+		versionIdMarker = aws.String(c.startVersionId)
+	}
+	return aws.String(c.startAfter), versionIdMarker
+}
+
+// inShards reports whether the key is within one of the shard prefixes, or whether there are no shards.
+func (c *Cleaner) inShards(key string) bool {
+	if len(c.shards) == 0 {
+		return true
+	}
+	for _, shard := range c.shards {
+		if strings.HasPrefix(key, c.prefix+shard) {
+			return true
+		}
+	}
+	return false
+}
+
+// listPages lists all versions and delete markers of the bucket under prefix, starting after the given markers if set,
+// and sends them page by page.
+func (c *Cleaner) listPages(ctx context.Context, pages chan<- *page, prefix string, nextKeyMarker, nextVersionIdMarker *string) error {
+	cutoff := c.now().Add(-c.olderThan)
+
+	var keeper *versionKeeper
+	if c.keepVersions > 0 {
+		keeper = &versionKeeper{n: c.keepVersions}
+	}
+
+	maxKeys := c.maxKeys
+	if c.ramp {
+		maxKeys = min(rampMaxKeys, c.maxKeys)
+	}
+
+	for number := 1; ; number++ {
+		// check ctx between pages too, so that a cancellation doesn't wait for the next API call to notice it.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		c.logger.Debug("Listing versions and delete markers", "prefix", prefix, "page", number, "maxKeys", maxKeys, "keyMarker", aws.ToString(nextKeyMarker), "versionIdMarker", aws.ToString(nextVersionIdMarker))
+		start := time.Now()
+		spanCtx, span := c.startSpan(ctx, "ListObjectVersions", func() []attribute.KeyValue {
+			return []attribute.KeyValue{attribute.String("prefix", prefix), attribute.Int("page", number)}
+		})
+		versions, deleteMarkers, keyMarker, versionIdMarker, err := c.listObjectVersions(spanCtx, c.bucket, prefix, maxKeys, nextKeyMarker, nextVersionIdMarker)
+		if span.IsRecording() {
+			span.SetAttributes(attribute.Int("versions", len(versions)), attribute.Int("deleteMarkers", len(deleteMarkers)))
+		}
+		endSpan(span, err)
+		if err != nil {
+			return fmt.Errorf("failed to list object versions: %w", err)
+		}
+		maxKeys = min(maxKeys*2, c.maxKeys)
+		nextKeyMarker, nextVersionIdMarker = keyMarker, versionIdMarker
+		c.logger.Info("Retrieved versions and delete markers", "prefix", prefix, "page", number, "versions", len(versions), "deleteMarkers", len(deleteMarkers), "duration", time.Since(start))
+
+		if keeper != nil {
+			versions, deleteMarkers = keeper.apply(versions, deleteMarkers, nextKeyMarker == nil && nextVersionIdMarker == nil)
+		}
+		versions = c.filterVersions(versions, cutoff)
+		deleteMarkers = c.filterDeleteMarkers(deleteMarkers, cutoff)
+		if versions, err = c.filterTagged(ctx, versions); err != nil {
+			return err
+		}
+		if versions, deleteMarkers, err = c.filterCommand(ctx, versions, deleteMarkers); err != nil {
+			return err
+		}
+
+		if len(versions) > 0 || len(deleteMarkers) > 0 {
+			select {
+			case pages <- &page{number: number, versions: versions, deleteMarkers: deleteMarkers, nextKeyMarker: nextKeyMarker, nextVersionIdMarker: nextVersionIdMarker}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		// the listing runs ahead of the deletion, so it can't start over from the beginning to double-check
+		// the bucket is empty; it stops once ListObjectVersions reports there are no more versions and delete markers.
+		if nextKeyMarker == nil && nextVersionIdMarker == nil {
+			return nil
+		}
+	}
+}
+
+// countPages counts all versions and delete markers of the bucket under prefix, starting after the given markers if set,
+// and passes the counts of each page to fn. It pages through the bucket like listPages.
+func (c *Cleaner) countPages(ctx context.Context, prefix string, nextKeyMarker, nextVersionIdMarker *string, fn func(objectCounts)) error {
+	maxKeys := c.maxKeys
+	if c.ramp {
+		maxKeys = min(rampMaxKeys, c.maxKeys)
+	}
+
+	for number := 1; ; number++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		start := time.Now()
+		spanCtx, span := c.startSpan(ctx, "ListObjectVersions", func() []attribute.KeyValue {
+			return []attribute.KeyValue{attribute.String("prefix", prefix), attribute.Int("page", number)}
+		})
+		counts, keyMarker, versionIdMarker, err := c.countObjectVersions(spanCtx, c.bucket, prefix, maxKeys, nextKeyMarker, nextVersionIdMarker)
+		if span.IsRecording() {
+			span.SetAttributes(attribute.Int("versions", counts.versions), attribute.Int("deleteMarkers", counts.deleteMarkers))
+		}
+		endSpan(span, err)
+		if err != nil {
+			return fmt.Errorf("failed to list object versions: %w", err)
+		}
+		maxKeys = min(maxKeys*2, c.maxKeys)
+		nextKeyMarker, nextVersionIdMarker = keyMarker, versionIdMarker
+		c.logger.Info("Counted versions and delete markers", "prefix", prefix, "page", number, "versions", counts.versions, "deleteMarkers", counts.deleteMarkers, "duration", time.Since(start))
+		fn(counts)
+
+		if nextKeyMarker == nil && nextVersionIdMarker == nil {
+			return nil
+		}
+	}
+}
+
+// readPages returns a page source that reads the versions and delete markers of the bucket from a manifest,
+// c.maxKeys entries at a time. filter tells whether the filters apply to them.
+func (c *Cleaner) readPages(r *ManifestReader, filter bool) func(ctx context.Context, pages chan<- *page) error {
+	return func(ctx context.Context, pages chan<- *page) error {
+		cutoff := c.now().Add(-c.olderThan)
+
+		for number := 1; ; number++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			var (
+				versions      []*Object
+				deleteMarkers []*Object
+				eof           bool
+			)
+			for len(versions)+len(deleteMarkers) < int(c.maxKeys) {
+				e, err := r.Read()
+				if errors.Is(err, io.EOF) {
+					eof = true
+					break
+				}
+				if err != nil {
+					return fmt.Errorf("failed to read the manifest: %w", err)
+				}
+				if e.Bucket != "" && e.Bucket != c.bucket {
+					continue
+				}
+				if e.VersionId == "" {
+					return fmt.Errorf("failed to read the manifest: no version ID for key %q", e.Key)
+				}
+
+				o := &Object{Key: e.Key, VersionId: e.VersionId, LastModified: e.LastModified, Size: e.Size, IsLatest: e.IsLatest}
+				if e.IsDeleteMarker {
+					deleteMarkers = append(deleteMarkers, o)
+				} else {
+					versions = append(versions, o)
+				}
+			}
+			c.logger.Info("Read versions and delete markers from the manifest", "page", number, "versions", len(versions), "deleteMarkers", len(deleteMarkers))
+
+			if filter {
+				versions = c.filterVersions(versions, cutoff)
+				deleteMarkers = c.filterDeleteMarkers(deleteMarkers, cutoff)
+				var err error
+				if versions, err = c.filterTagged(ctx, versions); err != nil {
+					return err
+				}
+				if versions, deleteMarkers, err = c.filterCommand(ctx, versions, deleteMarkers); err != nil {
+					return err
+				}
+			}
+
+			if len(versions) > 0 || len(deleteMarkers) > 0 {
+				select {
+				case pages <- &page{number: number, versions: versions, deleteMarkers: deleteMarkers, manifest: true}:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+
+			if eof {
+				return nil
+			}
+		}
+	}
+}
+
+func (c *Cleaner) deleteVersions(ctx context.Context, page int, versions []*Object) (int, error) {
+	if c.dryRun {
+		for _, v := range versions {
+			c.logger.Info("Would delete version", "page", page, "key", v.Key, "versionId", v.VersionId)
+		}
+		return len(versions), nil
+	}
+	start := time.Now()
+	spanCtx, span := c.startSpan(ctx, "DeleteObjects", func() []attribute.KeyValue {
+		return []attribute.KeyValue{attribute.Int("page", page), attribute.Int("objects", len(versions)), attribute.Bool("deleteMarkers", false)}
+	})
+	deleted, err := c.deleteObjects(spanCtx, c.bucket, versions)
+	if span.IsRecording() {
+		span.SetAttributes(attribute.Int("deleted", deleted))
+	}
+	endSpan(span, err)
+	c.logDeleted(versions, deleted, err, false)
+	c.logger.Info("Deleted versions", "page", page, "deleted", deleted, "duration", time.Since(start))
+	if err != nil {
+		return deleted, fmt.Errorf("failed to delete versions: %w", err)
+	}
+	return deleted, nil
+}
+
+func (c *Cleaner) deleteDeleteMarkers(ctx context.Context, page int, deleteMarkers []*Object) (int, error) {
+	if c.dryRun {
+		for _, d := range deleteMarkers {
+			c.logger.Info("Would delete delete marker", "page", page, "key", d.Key, "versionId", d.VersionId)
+		}
+		return len(deleteMarkers), nil
+	}
+	start := time.Now()
+	spanCtx, span := c.startSpan(ctx, "DeleteObjects", func() []attribute.KeyValue {
+		return []attribute.KeyValue{attribute.Int("page", page), attribute.Int("objects", len(deleteMarkers)), attribute.Bool("deleteMarkers", true)}
+	})
+	deleted, err := c.deleteObjects(spanCtx, c.bucket, deleteMarkers)
+	if span.IsRecording() {
+		span.SetAttributes(attribute.Int("deleted", deleted))
+	}
+	endSpan(span, err)
+	c.logDeleted(deleteMarkers, deleted, err, true)
+	c.logger.Info("Deleted delete markers", "page", page, "deleted", deleted, "duration", time.Since(start))
+	if err != nil {
+		return deleted, fmt.Errorf("failed to delete delete markers: %w", err)
+	}
+	return deleted, nil
+}
+
+// logDeleted logs each of the objects that were actually deleted out of the given ones with logObjects.
+func (c *Cleaner) logDeleted(objects []*Object, n int, err error, deleteMarker bool) {
+	if !c.logObjects {
+		return
+	}
+	for _, o := range deletedObjects(objects, n, err) {
+		c.logger.Info("Deleted", "key", o.Key, "versionId", o.VersionId, "deleteMarker", deleteMarker)
+	}
+}
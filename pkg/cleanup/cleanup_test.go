@@ -0,0 +1,531 @@
+package cleanup
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCleanup(t *testing.T) {
+	errList := errors.New("list failed")
+	errDelete := errors.New("delete failed")
+	latest := func(objects []*Object) []*Object {
+		objects[0].IsLatest = true
+		return objects
+	}
+	// version returns a version modified the given number of minutes after the epoch.
+	version := func(key, versionId string, minutes int) *Object {
+		return &Object{Key: key, VersionId: versionId, Size: 1, LastModified: time.Unix(0, 0).Add(time.Duration(minutes) * time.Minute)}
+	}
+
+	tests := []struct {
+		name      string
+		pages     []fakePage
+		cfg       Config
+		listErr   error
+		errPage   int
+		deleteErr error
+		failKeys  map[string]string
+
+		want Result
+		// wantErr is matched with errors.Is.
+		wantErr error
+		// wantListCalls is left unchecked when negative, as the listing may run ahead of the deletion.
+		wantListCalls   int
+		wantDeleteCalls [][]string
+		// wantListMarkers, when set, are the markers of the ListObjectVersions calls.
+		wantListMarkers [][2]string
+		// wantFailures are the keys reported to OnFailure, in any order.
+		wantFailures []string
+	}{
+		{
+			name:            "single page",
+			pages:           []fakePage{{versions: testObjects("v", 3, 10), deleteMarkers: testObjects("d", 2, 0)}},
+			want:            Result{DeletedVersions: 3, DeletedDeleteMarkers: 2, FreedBytes: 30},
+			wantListCalls:   1,
+			wantDeleteCalls: [][]string{{"v1", "v2", "v3"}, {"d1", "d2"}},
+		},
+		{
+			name: "multiple pages",
+			pages: []fakePage{
+				{versions: testObjects("a", 2, 1)},
+				{versions: testObjects("b", 1, 1), deleteMarkers: testObjects("c", 1, 0)},
+				{deleteMarkers: testObjects("e", 2, 0)},
+			},
+			want:            Result{DeletedVersions: 3, DeletedDeleteMarkers: 3, FreedBytes: 3},
+			wantListCalls:   3,
+			wantDeleteCalls: [][]string{{"a1", "a2"}, {"b1"}, {"c1"}, {"e1", "e2"}},
+		},
+		{
+			name:          "empty bucket",
+			want:          Result{},
+			wantListCalls: 1,
+		},
+		{
+			// S3 may return an empty page that isn't the last one; the listing only ends without a next marker.
+			name: "empty page in between",
+			pages: []fakePage{
+				{versions: testObjects("a", 1, 0)},
+				{},
+				{versions: testObjects("b", 1, 0)},
+			},
+			want:            Result{DeletedVersions: 2},
+			wantListCalls:   3,
+			wantDeleteCalls: [][]string{{"a1"}, {"b1"}},
+		},
+		{
+			name: "list error",
+			pages: []fakePage{
+				{versions: testObjects("a", 2, 0)},
+				{versions: testObjects("b", 2, 0)},
+			},
+			listErr:         errList,
+			errPage:         1,
+			want:            Result{DeletedVersions: 2},
+			wantErr:         errList,
+			wantListCalls:   2,
+			wantDeleteCalls: [][]string{{"a1", "a2"}},
+		},
+		{
+			// a single batch, since the batches queued before the failure may still be deleted.
+			name:            "delete error",
+			pages:           []fakePage{{versions: testObjects("a", 2, 0)}},
+			deleteErr:       errDelete,
+			want:            Result{},
+			wantErr:         errDelete,
+			wantListCalls:   1,
+			wantDeleteCalls: [][]string{{"a1", "a2"}},
+		},
+		{
+			name:            "batching",
+			pages:           []fakePage{{versions: testObjects("v", 5, 0), deleteMarkers: testObjects("d", 3, 0)}},
+			cfg:             Config{DeleteBatchSize: 2},
+			want:            Result{DeletedVersions: 5, DeletedDeleteMarkers: 3},
+			wantListCalls:   1,
+			wantDeleteCalls: [][]string{{"v1", "v2"}, {"v3", "v4"}, {"v5"}, {"d1", "d2"}, {"d3"}},
+		},
+		{
+			// the dry run is handled above the client, which deleteObjects is never called on.
+			name:          "dry run",
+			pages:         []fakePage{{versions: testObjects("v", 2, 5), deleteMarkers: testObjects("d", 1, 0)}},
+			cfg:           Config{DryRun: true},
+			want:          Result{DeletedVersions: 2, DeletedDeleteMarkers: 1, FreedBytes: 10},
+			wantListCalls: 1,
+		},
+		{
+			name:            "keep latest",
+			pages:           []fakePage{{versions: latest(testObjects("v", 3, 1)), deleteMarkers: latest(testObjects("d", 2, 0))}},
+			cfg:             Config{KeepLatest: true},
+			want:            Result{DeletedVersions: 2, DeletedDeleteMarkers: 1, FreedBytes: 2},
+			wantListCalls:   1,
+			wantDeleteCalls: [][]string{{"v2", "v3"}, {"d2"}},
+		},
+		{
+			name:            "delete markers only",
+			pages:           []fakePage{{versions: testObjects("v", 2, 1), deleteMarkers: testObjects("d", 2, 0)}},
+			cfg:             Config{MarkersOnly: true},
+			want:            Result{DeletedDeleteMarkers: 2},
+			wantListCalls:   1,
+			wantDeleteCalls: [][]string{{"d1", "d2"}},
+		},
+		{
+			name:            "versions only",
+			pages:           []fakePage{{versions: testObjects("v", 2, 1), deleteMarkers: testObjects("d", 2, 0)}},
+			cfg:             Config{VersionsOnly: true},
+			want:            Result{DeletedVersions: 2, FreedBytes: 2},
+			wantListCalls:   1,
+			wantDeleteCalls: [][]string{{"v1", "v2"}},
+		},
+		{
+			// the versions of b continue on the next page, so the older one is only deleted once they are all listed.
+			name: "keep versions",
+			pages: []fakePage{
+				{versions: []*Object{version("a", "a2", 2), version("a", "a1", 1), version("b", "b1", 1)}},
+				{versions: []*Object{version("b", "b2", 2), version("c", "c1", 1)}},
+			},
+			cfg:             Config{KeepVersions: 1},
+			want:            Result{DeletedVersions: 2, FreedBytes: 2},
+			wantListCalls:   2,
+			wantDeleteCalls: [][]string{{"a"}, {"b"}},
+		},
+		{
+			name: "delete markers last",
+			pages: []fakePage{
+				{versions: testObjects("a", 1, 0), deleteMarkers: testObjects("b", 1, 0)},
+				{versions: testObjects("c", 1, 0), deleteMarkers: testObjects("d", 1, 0)},
+			},
+			cfg:             Config{MarkersLast: true, Workers: 1},
+			want:            Result{DeletedVersions: 2, DeletedDeleteMarkers: 2},
+			wantListCalls:   2,
+			wantDeleteCalls: [][]string{{"a1"}, {"c1"}, {"b1"}, {"d1"}},
+		},
+		{
+			// the delete marker of k1 would expose no version but the one that failed to be deleted, so it's kept.
+			name:            "delete markers last after a failed version",
+			pages:           []fakePage{{versions: testObjects("k", 2, 0), deleteMarkers: []*Object{{Key: "k1", VersionId: "d1"}, {Key: "k2", VersionId: "d2"}}}},
+			cfg:             Config{MarkersLast: true, ContinueOnError: true, Workers: 1},
+			failKeys:        map[string]string{"k1": "AccessDenied"},
+			want:            Result{DeletedVersions: 1, DeletedDeleteMarkers: 1, FailedObjects: 1},
+			wantErr:         ErrObjectsNotDeleted,
+			wantListCalls:   1,
+			wantDeleteCalls: [][]string{{"k1", "k2"}, {"k2"}},
+			wantFailures:    []string{"k1"},
+		},
+		{
+			name:            "continue on error",
+			pages:           []fakePage{{versions: testObjects("v", 3, 1)}, {versions: testObjects("w", 2, 1)}},
+			cfg:             Config{ContinueOnError: true},
+			failKeys:        map[string]string{"v2": "AccessDenied", "w1": "InternalError"},
+			want:            Result{DeletedVersions: 3, FreedBytes: 3, FailedObjects: 2},
+			wantErr:         ErrObjectsNotDeleted,
+			wantListCalls:   2,
+			wantDeleteCalls: [][]string{{"v1", "v2", "v3"}, {"w1", "w2"}},
+			wantFailures:    []string{"v2", "w1"},
+		},
+		{
+			// a failed call fails all its objects, and the run goes on with the next page.
+			name:            "continue on a failed call",
+			pages:           []fakePage{{versions: testObjects("v", 2, 1)}, {versions: testObjects("w", 1, 1)}},
+			cfg:             Config{ContinueOnError: true},
+			deleteErr:       errDelete,
+			want:            Result{FailedObjects: 3},
+			wantErr:         errDelete,
+			wantListCalls:   2,
+			wantDeleteCalls: [][]string{{"v1", "v2"}, {"w1"}},
+			wantFailures:    []string{"v1", "v2", "w1"},
+		},
+		{
+			// the cap truncates the second page, and the third one is never deleted.
+			name: "max deletes",
+			pages: []fakePage{
+				{versions: testObjects("a", 2, 1)},
+				{versions: testObjects("b", 2, 1)},
+				{versions: testObjects("c", 2, 1)},
+			},
+			cfg:             Config{MaxDeletes: 3},
+			want:            Result{DeletedVersions: 3, FreedBytes: 3, MaxDeletesReached: true},
+			wantListCalls:   -1,
+			wantDeleteCalls: [][]string{{"a1", "a2"}, {"b1"}},
+		},
+		{
+			name:            "max deletes not reached",
+			pages:           []fakePage{{versions: testObjects("a", 2, 1)}},
+			cfg:             Config{MaxDeletes: 3},
+			want:            Result{DeletedVersions: 2, FreedBytes: 2},
+			wantListCalls:   1,
+			wantDeleteCalls: [][]string{{"a1", "a2"}},
+		},
+		{
+			name:            "start after",
+			pages:           []fakePage{{versions: testObjects("v", 1, 0)}},
+			cfg:             Config{StartAfter: "k"},
+			want:            Result{DeletedVersions: 1},
+			wantListCalls:   1,
+			wantDeleteCalls: [][]string{{"v1"}},
+			wantListMarkers: [][2]string{{"k", ""}},
+		},
+		{
+			name:            "start after a version",
+			pages:           []fakePage{{versions: testObjects("v", 1, 0)}, {versions: testObjects("w", 1, 0)}},
+			cfg:             Config{StartAfter: "k", StartVersionId: "v5"},
+			want:            Result{DeletedVersions: 2},
+			wantListCalls:   2,
+			wantDeleteCalls: [][]string{{"v1"}, {"w1"}},
+			wantListMarkers: [][2]string{{"k", "v5"}, {"1", "next"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeS3Client{pages: tt.pages, listErr: tt.listErr, listErrPage: tt.errPage, deleteErr: tt.deleteErr, failKeys: tt.failKeys}
+			var (
+				mu       sync.Mutex
+				failures []string
+			)
+			tt.cfg.OnFailure = func(e *ManifestEntry, err error) {
+				mu.Lock()
+				defer mu.Unlock()
+				failures = append(failures, e.Key)
+			}
+			c := newTestCleaner(t, f, tt.cfg)
+
+			r, err := c.Cleanup(context.Background())
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("Cleanup() error = %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Cleanup() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(*r, tt.want) {
+				t.Errorf("Cleanup() = %+v, want %+v", *r, tt.want)
+			}
+			if tt.wantListCalls >= 0 && f.listCalls != tt.wantListCalls {
+				t.Errorf("ListObjectVersions calls = %d, want %d", f.listCalls, tt.wantListCalls)
+			}
+			if !reflect.DeepEqual(f.deleteCalls, tt.wantDeleteCalls) {
+				t.Errorf("DeleteObjects calls = %v, want %v", f.deleteCalls, tt.wantDeleteCalls)
+			}
+			if tt.wantListMarkers != nil && !reflect.DeepEqual(f.listMarkers, tt.wantListMarkers) {
+				t.Errorf("ListObjectVersions markers = %v, want %v", f.listMarkers, tt.wantListMarkers)
+			}
+			sort.Strings(failures)
+			if !reflect.DeepEqual(failures, tt.wantFailures) {
+				t.Errorf("OnFailure keys = %v, want %v", failures, tt.wantFailures)
+			}
+		})
+	}
+}
+
+func TestCleanupCanceled(t *testing.T) {
+	pages := make([]fakePage, 100)
+	for i := range pages {
+		pages[i] = fakePage{versions: testObjects("p"+strconv.Itoa(i)+"-", 10, 1)}
+	}
+
+	tests := []struct {
+		name string
+		// cancelOnDelete cancels the context during the first DeleteObjects call instead of before the cleanup.
+		cancelOnDelete bool
+		want           Result
+		wantDeletes    int
+		// maxListCalls bounds how far the listing may have run ahead of the deletion.
+		maxListCalls int
+	}{
+		{name: "before the cleanup", want: Result{}, wantDeletes: 0, maxListCalls: 0},
+		{name: "during a deletion", cancelOnDelete: true, want: Result{DeletedVersions: 10, FreedBytes: 10}, wantDeletes: 1, maxListCalls: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			goroutines := runtime.NumGoroutine()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			f := &fakeS3Client{pages: pages}
+			if tt.cancelOnDelete {
+				f.onDelete = func([]*Object) { cancel() }
+			} else {
+				cancel()
+			}
+			// a single worker, as others could pick up a batch before the cancellation.
+			c := newTestCleaner(t, f, Config{Workers: 1})
+
+			r, err := c.Cleanup(ctx)
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("Cleanup() error = %v, want %v", err, context.Canceled)
+			}
+			// the in-flight deletion completes so that the Result stays accurate, but no other batch is deleted.
+			if !reflect.DeepEqual(*r, tt.want) {
+				t.Errorf("Cleanup() = %+v, want %+v", *r, tt.want)
+			}
+			if len(f.deleteCalls) != tt.wantDeletes {
+				t.Errorf("DeleteObjects calls = %d, want %d", len(f.deleteCalls), tt.wantDeletes)
+			}
+			if f.listCalls > tt.maxListCalls {
+				t.Errorf("ListObjectVersions calls = %d, want at most %d", f.listCalls, tt.maxListCalls)
+			}
+
+			// the listing goroutine and the workers must all have exited.
+			deadline := time.Now().Add(time.Second)
+			for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if n := runtime.NumGoroutine(); n > goroutines {
+				t.Errorf("%d goroutines left running, %d before the cleanup", n, goroutines)
+			}
+		})
+	}
+}
+
+// BenchmarkDelete measures the throughput of the worker pool for several -workers values against a fake client
+// that takes 2ms per DeleteObjects call, over 20 pages of 1000 versions deleted in batches of 100.
+func BenchmarkDelete(b *testing.B) {
+	pages := make([]fakePage, 20)
+	for i := range pages {
+		pages[i] = fakePage{versions: testObjects("p"+strconv.Itoa(i)+"-", 1000, 1)}
+	}
+
+	for _, workers := range []int{1, 2, 4, 8, 16} {
+		b.Run("workers="+strconv.Itoa(workers), func(b *testing.B) {
+			f := &fakeS3Client{pages: pages, deleteDelay: 2 * time.Millisecond}
+			c := newTestCleaner(b, f, Config{Workers: workers, DeleteBatchSize: 100})
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				f.deleteCalls = nil
+				if _, err := c.Cleanup(context.Background()); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(f.deleted)/b.Elapsed().Seconds(), "objects/s")
+		})
+	}
+}
+
+func TestDeduper(t *testing.T) {
+	o := func(key, versionId string) *Object { return &Object{Key: key, VersionId: versionId} }
+	keys := func(objects []*Object) []string {
+		var keys []string
+		for _, o := range objects {
+			keys = append(keys, o.Key+"@"+o.VersionId)
+		}
+		return keys
+	}
+
+	tests := []struct {
+		name  string
+		pages []*page
+		// want are the versions kept of each page.
+		want    [][]string
+		wantDup int
+	}{
+		{
+			name:    "in a page",
+			pages:   []*page{{versions: []*Object{o("a", "v1"), o("a", "v1"), o("b", "v1")}}},
+			want:    [][]string{{"a@v1", "b@v1"}},
+			wantDup: 1,
+		},
+		{
+			name: "across pages",
+			pages: []*page{
+				{versions: []*Object{o("a", "v1"), o("b", "v1")}},
+				{versions: []*Object{o("b", "v1"), o("c", "v1")}},
+			},
+			want:    [][]string{{"a@v1", "b@v1"}, {"c@v1"}},
+			wantDup: 1,
+		},
+		{
+			// the key and version ID name a single version, whatever else the entries say about it.
+			name:    "same version with other attributes",
+			pages:   []*page{{versions: []*Object{o("a", "null"), {Key: "a", VersionId: "null", Size: 10, IsLatest: true}}}},
+			want:    [][]string{{"a@null"}},
+			wantDup: 1,
+		},
+		{
+			// a listing is sorted, so only the greatest key of a page can show up again in the next one.
+			name: "listing bounded to the last key",
+			pages: []*page{
+				{versions: []*Object{o("a", "v1"), o("b", "v1")}},
+				{versions: []*Object{o("a", "v1")}},
+			},
+			want: [][]string{{"a@v1", "b@v1"}, {"a@v1"}},
+		},
+		{
+			// a manifest merging a retry manifest with a fresh listing may repeat an entry anywhere.
+			name: "manifest over the whole run",
+			pages: []*page{
+				{versions: []*Object{o("a", "v1"), o("b", "v1")}, manifest: true},
+				{versions: []*Object{o("c", "v1")}, manifest: true},
+				{versions: []*Object{o("a", "v1"), o("d", "v1")}, manifest: true},
+			},
+			want:    [][]string{{"a@v1", "b@v1"}, {"c@v1"}, {"d@v1"}},
+			wantDup: 1,
+		},
+		{
+			name: "delete markers",
+			pages: []*page{
+				{versions: []*Object{o("a", "v1")}, deleteMarkers: []*Object{o("b", "d1")}},
+				{deleteMarkers: []*Object{o("b", "d1"), o("b", "d2")}},
+			},
+			want:    [][]string{{"a@v1"}, nil},
+			wantDup: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var d deduper
+			dup := 0
+			for i, p := range tt.pages {
+				dup += d.dedupe(p)
+				if got := keys(p.versions); !reflect.DeepEqual(got, tt.want[i]) {
+					t.Errorf("page %d versions = %v, want %v", i, got, tt.want[i])
+				}
+			}
+			if dup != tt.wantDup {
+				t.Errorf("dropped %d duplicates, want %d", dup, tt.wantDup)
+			}
+			if last := tt.pages[len(tt.pages)-1]; !last.manifest {
+				for id := range d.seen {
+					if id[0] != maxKey(last) {
+						t.Errorf("seen holds %v beyond the greatest key of the last page", id)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCleanupManifestDuplicates(t *testing.T) {
+	// with a page per entry, the repeated entry is two pages away from the first one.
+	r, err := NewManifestReader(strings.NewReader("key,versionId\na,v1\nb,v1\na,v1\n"), ManifestFormatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeS3Client{}
+	got, err := newTestCleaner(t, f, Config{MaxKeys: 1, Workers: 1}).CleanupManifest(context.Background(), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Result{DeletedVersions: 2}); !reflect.DeepEqual(*got, want) {
+		t.Errorf("CleanupManifest() = %+v, want %+v", *got, want)
+	}
+	if want := [][]string{{"a"}, {"b"}}; !reflect.DeepEqual(f.deleteCalls, want) {
+		t.Errorf("DeleteObjects calls = %v, want %v", f.deleteCalls, want)
+	}
+}
+
+// maxKey returns the greatest key of the page.
+func maxKey(p *page) string {
+	var last string
+	for _, o := range append(append([]*Object(nil), p.versions...), p.deleteMarkers...) {
+		last = max(last, o.Key)
+	}
+	return last
+}
+
+func TestListObjectLockError(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	errLock := errors.New("access denied")
+	f := &fakeS3Client{pages: []fakePage{{versions: testObjects("v", 2, 0)}, {versions: testObjects("w", 2, 0)}}, lockErr: errLock}
+	c := newTestCleaner(t, f, Config{ListRetention: true})
+
+	_, err := c.List(context.Background(), func(*ManifestEntry) error { return nil })
+	if !errors.Is(err, errLock) {
+		t.Fatalf("List() error = %v, want %v", err, errLock)
+	}
+	// the Object Lock configuration is checked before the listing starts, which would otherwise be left running.
+	if f.listCalls != 0 {
+		t.Errorf("ListObjectVersions calls = %d, want 0", f.listCalls)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("%d goroutines left running, %d before the listing", n, goroutines)
+	}
+}
+
+func TestCleanupErrorWrappedOnce(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		page fakePage
+		want string
+	}{
+		{name: "versions", page: fakePage{versions: testObjects("v", 1, 0)}, want: "failed to delete versions: "},
+		{name: "delete markers", page: fakePage{deleteMarkers: testObjects("d", 1, 0)}, want: "failed to delete delete markers: "},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeS3Client{pages: []fakePage{tt.page}, deleteErr: errors.New("delete failed")}
+			_, err := newTestCleaner(t, f, Config{}).Cleanup(context.Background())
+			if err == nil {
+				t.Fatal("Cleanup() error = nil, want an error")
+			}
+			if n := strings.Count(err.Error(), tt.want); n != 1 {
+				t.Errorf("Cleanup() error = %q, want %q once", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package cleanup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// commandWaitDelay bounds the wait for the output pipes of the filter command to close once it's exited or been killed,
+// e.g., when it leaves a background process holding them open.
+const commandWaitDelay = 5 * time.Second
+
+// commandStderrLimit is the maximum number of bytes of the stderr of the filter command included in its errors.
+const commandStderrLimit = 1024
+
+type (
+	// CommandFilter selects the versions and delete markers to delete with an external command, e.g., to implement a custom retention policy.
+	// The command is run with sh -c once per page, after the other filters. It's passed the candidates of the page on stdin
+	// as a JSON array of manifest entries, and must print the JSON array of the ones to delete on stdout and exit with status 0.
+	// Only the key, versionId, and isDeleteMarker of the printed entries are read, and each must be one of the candidates.
+	CommandFilter struct {
+		Command string
+	}
+
+	// candidateKey identifies a version or a delete marker among the candidates passed to the filter command.
+	candidateKey struct {
+		key          string
+		versionId    string
+		deleteMarker bool
+	}
+)
+
+// filterCommand returns the versions and delete markers that the filter command selects for deletion.
+func (c *Cleaner) filterCommand(ctx context.Context, versions, deleteMarkers []*Object) ([]*Object, []*Object, error) {
+	if c.commandFilter == nil || len(versions)+len(deleteMarkers) == 0 {
+		return versions, deleteMarkers, nil
+	}
+
+	candidates := make(map[candidateKey]*Object, len(versions)+len(deleteMarkers))
+	entries := make([]*ManifestEntry, 0, len(versions)+len(deleteMarkers))
+	for _, v := range versions {
+		candidates[candidateKey{key: v.Key, versionId: v.VersionId}] = v
+		entries = append(entries, c.manifestEntry(v, false))
+	}
+	for _, d := range deleteMarkers {
+		candidates[candidateKey{key: d.Key, versionId: d.VersionId, deleteMarker: true}] = d
+		entries = append(entries, c.manifestEntry(d, true))
+	}
+	stdin, err := json.Marshal(entries)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", c.commandFilter.Command)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = commandWaitDelay
+	start := time.Now()
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		return nil, nil, fmt.Errorf("filter command failed: %w%s", err, stderrSuffix(stderr.Bytes()))
+	}
+
+	var selected []*ManifestEntry
+	if err := json.Unmarshal(stdout.Bytes(), &selected); err != nil {
+		return nil, nil, fmt.Errorf("filter command printed an invalid JSON array of entries: %w%s", err, stderrSuffix(stderr.Bytes()))
+	}
+
+	var filteredVersions, filteredDeleteMarkers []*Object
+	seen := make(map[candidateKey]bool, len(selected))
+	for _, e := range selected {
+		k := candidateKey{key: e.Key, versionId: e.VersionId, deleteMarker: e.IsDeleteMarker}
+		o, ok := candidates[k]
+		if !ok {
+			return nil, nil, fmt.Errorf("filter command selected key %q version %q, which isn't one of the candidates", e.Key, e.VersionId)
+		}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		if e.IsDeleteMarker {
+			filteredDeleteMarkers = append(filteredDeleteMarkers, o)
+		} else {
+			filteredVersions = append(filteredVersions, o)
+		}
+	}
+	c.logger.Info("Filtered versions and delete markers with the filter command", "candidates", len(entries), "selected", len(seen), "duration", time.Since(start))
+	return filteredVersions, filteredDeleteMarkers, nil
+}
+
+// stderrSuffix formats the stderr of the filter command to append to an error, keeping its end if it's long.
+func stderrSuffix(stderr []byte) string {
+	s := strings.TrimSpace(string(stderr))
+	if s == "" {
+		return ""
+	}
+	if len(s) > commandStderrLimit {
+		s = "..." + s[len(s)-commandStderrLimit:]
+	}
+	return ": " + s
+}
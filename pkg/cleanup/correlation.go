@@ -0,0 +1,33 @@
+package cleanup
+
+import "context"
+
+type correlationIDKey struct{}
+
+// WithCorrelationID returns a copy of ctx carrying a correlation ID. The Cleaner methods and ListBuckets called with it
+// add it to every log line as "correlationId", e.g., to tie the logs of a cleanup back to the job that started it.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+// CorrelationID returns the correlation ID carried by ctx, or "" if there's none.
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDKey{}).(string)
+	return id
+}
+
+// withCorrelationID returns a shallow copy of c that logs the correlation ID of ctx, or c itself if ctx has none.
+func (c *Cleaner) withCorrelationID(ctx context.Context) *Cleaner {
+	id := CorrelationID(ctx)
+	if id == "" {
+		return c
+	}
+	cc := *c
+	cc.logger = c.logger.With("correlationId", id)
+	if cli, ok := c.s3Client.(*s3cli); ok {
+		s := *cli
+		s.logger = cli.logger.With("correlationId", id)
+		cc.s3Client = &s
+	}
+	return &cc
+}
@@ -0,0 +1,207 @@
+package cleanup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+type (
+	// fakeS3Client is an s3Client serving scripted pages of versions and delete markers and recording the DeleteObjects calls.
+	// The key marker of each page is the index of the next one, so the listing ends after the last page.
+	fakeS3Client struct {
+		pages []fakePage
+		// listErr, when set, fails the listing of the page at index listErrPage.
+		listErr     error
+		listErrPage int
+		// deleteErr, when set, fails every deleteObjects call without deleting anything.
+		deleteErr error
+		// failKeys fails the deletion of the objects of these keys with the given error codes, like the per-object errors of DeleteObjects.
+		failKeys map[string]string
+		// deleteDelay is slept by each deleteObjects call, like the latency of S3.
+		deleteDelay time.Duration
+		// onDelete, when set, is called at the start of each deleteObjects call.
+		onDelete func(objects []*Object)
+		// lockErr, when set, fails getObjectLockEnabled.
+		lockErr error
+		// uploads are the incomplete multipart uploads listMultipartUploads serves in a single page.
+		uploads []*upload
+		// objects are the bodies getObject serves, by "bucket/key".
+		objects map[string][]byte
+
+		mu        sync.Mutex
+		listCalls int
+		// listMarkers are the key and version ID markers of each listObjectVersions call, empty for none.
+		listMarkers [][2]string
+		deleteCalls [][]string
+		deleted     int
+		aborted     []string
+	}
+
+	fakePage struct {
+		versions      []*Object
+		deleteMarkers []*Object
+	}
+)
+
+// newTestCleaner creates a Cleaner of bucket "test" with cfg on top of the fake client, logging nothing.
+func newTestCleaner(t testing.TB, f *fakeS3Client, cfg Config) *Cleaner {
+	t.Helper()
+	cfg.Bucket = "test"
+	cfg.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	c, err := New(nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.s3Client = f
+	return c
+}
+
+// testObjects returns n objects with the keys prefix1 to prefixN, each of the given size.
+func testObjects(prefix string, n int, size int64) []*Object {
+	objects := make([]*Object, n)
+	for i := range objects {
+		objects[i] = &Object{Key: prefix + strconv.Itoa(i+1), VersionId: "v" + strconv.Itoa(i+1), Size: size}
+	}
+	return objects
+}
+
+func (f *fakeS3Client) headBucket(ctx context.Context, bucket string) (string, error) { return "", nil }
+
+func (f *fakeS3Client) deleteBucket(ctx context.Context, bucket string) error { return nil }
+
+func (f *fakeS3Client) listBuckets(ctx context.Context) ([]string, error) { return nil, nil }
+
+func (f *fakeS3Client) listMultipartUploads(ctx context.Context, bucket, prefix string, keyMarker, uploadIdMarker *string) ([]*upload, *string, *string, error) {
+	var uploads []*upload
+	for _, u := range f.uploads {
+		if strings.HasPrefix(u.Key, prefix) {
+			uploads = append(uploads, u)
+		}
+	}
+	return uploads, nil, nil, nil
+}
+
+func (f *fakeS3Client) abortMultipartUpload(ctx context.Context, bucket, key, uploadId string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.aborted = append(f.aborted, key)
+	return nil
+}
+
+func (f *fakeS3Client) getObjectTagging(ctx context.Context, bucket, key, versionId string) (map[string]string, error) {
+	return nil, nil
+}
+
+func (f *fakeS3Client) getObject(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	b, ok := f.objects[bucket+"/"+key]
+	if !ok {
+		return nil, errors.New("NoSuchKey")
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (f *fakeS3Client) getBucketVersioning(ctx context.Context, bucket string) (string, error) {
+	return "Enabled", nil
+}
+
+func (f *fakeS3Client) getObjectLockEnabled(ctx context.Context, bucket string) (bool, error) {
+	return false, f.lockErr
+}
+
+func (f *fakeS3Client) getObjectRetention(ctx context.Context, bucket, key, versionId string) (string, time.Time, error) {
+	return "", time.Time{}, nil
+}
+
+func (f *fakeS3Client) getObjectLegalHold(ctx context.Context, bucket, key, versionId string) (bool, error) {
+	return false, nil
+}
+
+func (f *fakeS3Client) listObjectVersions(ctx context.Context, bucket, prefix string, maxKeys int64, keyMarker, versionIdMarker *string) ([]*Object, []*Object, *string, *string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.listCalls++
+	f.listMarkers = append(f.listMarkers, [2]string{aws.ToString(keyMarker), aws.ToString(versionIdMarker)})
+
+	i := 0
+	if keyMarker != nil {
+		i, _ = strconv.Atoi(*keyMarker)
+	}
+	if f.listErr != nil && i == f.listErrPage {
+		return nil, nil, nil, nil, f.listErr
+	}
+	if i >= len(f.pages) {
+		return nil, nil, nil, nil, nil
+	}
+
+	// the Cleaner may filter the pages in place, so it gets copies.
+	p := f.pages[i]
+	versions := append([]*Object(nil), p.versions...)
+	deleteMarkers := append([]*Object(nil), p.deleteMarkers...)
+	if i+1 == len(f.pages) {
+		return versions, deleteMarkers, nil, nil, nil
+	}
+	return versions, deleteMarkers, aws.String(strconv.Itoa(i + 1)), aws.String("next"), nil
+}
+
+func (f *fakeS3Client) firstObjectVersion(ctx context.Context, bucket string) (string, string, bool, error) {
+	for _, p := range f.pages {
+		if len(p.versions) > 0 {
+			return p.versions[0].Key, p.versions[0].VersionId, true, nil
+		}
+		if len(p.deleteMarkers) > 0 {
+			return p.deleteMarkers[0].Key, p.deleteMarkers[0].VersionId, true, nil
+		}
+	}
+	return "", "", false, nil
+}
+
+func (f *fakeS3Client) countObjectVersions(ctx context.Context, bucket, prefix string, maxKeys int64, keyMarker, versionIdMarker *string) (objectCounts, *string, *string, error) {
+	versions, deleteMarkers, nextKeyMarker, nextVersionIdMarker, err := f.listObjectVersions(ctx, bucket, prefix, maxKeys, keyMarker, versionIdMarker)
+	counts := objectCounts{versions: len(versions), deleteMarkers: len(deleteMarkers)}
+	for _, v := range versions {
+		counts.bytes += v.Size
+	}
+	return counts, nextKeyMarker, nextVersionIdMarker, err
+}
+
+func (f *fakeS3Client) deleteObjects(ctx context.Context, bucket string, objects []*Object) (int, error) {
+	if f.onDelete != nil {
+		f.onDelete(objects)
+	}
+	if f.deleteDelay > 0 {
+		time.Sleep(f.deleteDelay)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := make([]string, len(objects))
+	for i, o := range objects {
+		keys[i] = o.Key
+	}
+	f.deleteCalls = append(f.deleteCalls, keys)
+	if f.deleteErr != nil {
+		return 0, f.deleteErr
+	}
+	var failures []*deleteFailure
+	for _, o := range objects {
+		if code, ok := f.failKeys[o.Key]; ok {
+			failures = append(failures, &deleteFailure{Object: o, Code: code, Message: "injected"})
+		}
+	}
+	deleted := len(objects) - len(failures)
+	f.deleted += deleted
+	if len(failures) > 0 {
+		return deleted, &deleteObjectsError{failures: failures}
+	}
+	return deleted, nil
+}
@@ -0,0 +1,224 @@
+package cleanup
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// nullVersionId is the version ID of the objects written before versioning was enabled on the bucket.
+const nullVersionId = "null"
+
+// InventoryFormatCSV is the only S3 Inventory file format that can be read; ORC and Parquet reports aren't supported.
+const InventoryFormatCSV = "CSV"
+
+// inventoryColumns maps the fields of the schema of S3 Inventory reports to the columns of CSV manifests.
+var inventoryColumns = map[string]string{
+	"Bucket":           "bucket",
+	"Key":              "key",
+	"VersionId":        "versionId",
+	"IsDeleteMarker":   "isDeleteMarker",
+	"LastModifiedDate": "lastModified",
+	"Size":             "size",
+	"IsLatest":         "isLatest",
+}
+
+// ErrUnsupportedInventoryFormat is reported for S3 Inventory reports in ORC or Parquet format, which can't be read.
+var ErrUnsupportedInventoryFormat = errors.New("unsupported inventory file format")
+
+type (
+	// InventoryManifest is the manifest.json of an S3 Inventory report, which lists the data files of the report.
+	InventoryManifest struct {
+		SourceBucket string `json:"sourceBucket"`
+		// DestinationBucket is the ARN of the bucket the data files are stored in.
+		DestinationBucket string          `json:"destinationBucket"`
+		FileFormat        string          `json:"fileFormat"`
+		FileSchema        string          `json:"fileSchema"`
+		Files             []InventoryFile `json:"files"`
+	}
+
+	// InventoryFile is a data file of an S3 Inventory report.
+	InventoryFile struct {
+		Key         string `json:"key"`
+		Size        int64  `json:"size"`
+		MD5Checksum string `json:"MD5checksum"`
+	}
+
+	// inventoryFiles reads the data files of an S3 Inventory report as a single stream.
+	inventoryFiles struct {
+		ctx    context.Context
+		s3     s3Client
+		bucket string
+		files  []InventoryFile
+		// key, body, and in are the data file being read, its object body, and its decompressed content.
+		key  string
+		body io.ReadCloser
+		in   io.Reader
+	}
+)
+
+// CleanupInventory deletes the versions and delete markers listed in the S3 Inventory report of the bucket
+// whose manifest.json is at source, an s3://bucket/key URL or a local path, instead of listing the bucket.
+// The manifest and the data files are got with the client of the Cleaner, so they're retried and sent with
+// the same options as the other calls; S3 Inventory requires the destination bucket to be in the same region.
+// The report must be the one of the bucket, and the deletion behaves as with CleanupManifest.
+func (c *Cleaner) CleanupInventory(ctx context.Context, source string) (*Result, error) {
+	m, err := c.readInventoryManifest(ctx, source)
+	if err != nil {
+		return &Result{}, err
+	}
+	if m.SourceBucket != c.bucket {
+		return &Result{}, fmt.Errorf("the inventory report is of bucket %q", m.SourceBucket)
+	}
+
+	files := &inventoryFiles{ctx: ctx, s3: c.s3Client, bucket: m.DestinationBucketName(), files: m.Files}
+	defer files.Close()
+	r, err := NewInventoryReader(bufio.NewReader(files), m.FileSchema)
+	if err != nil {
+		return &Result{}, err
+	}
+	return c.CleanupManifest(ctx, r)
+}
+
+// readInventoryManifest reads the manifest.json of an S3 Inventory report from source, an s3://bucket/key URL or a local path.
+func (c *Cleaner) readInventoryManifest(ctx context.Context, source string) (*InventoryManifest, error) {
+	var in io.ReadCloser
+	if bucket, key, ok := strings.Cut(strings.TrimPrefix(source, "s3://"), "/"); strings.HasPrefix(source, "s3://") {
+		if !ok || bucket == "" || key == "" {
+			return nil, fmt.Errorf("invalid inventory manifest URL %q, expected s3://bucket/key", source)
+		}
+		body, err := c.getObject(ctx, bucket, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the inventory manifest: %w", err)
+		}
+		in = body
+	} else {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open the inventory manifest: %w", err)
+		}
+		in = f
+	}
+	defer in.Close()
+	return ParseInventoryManifest(in)
+}
+
+// ParseInventoryManifest parses the manifest.json of an S3 Inventory report. The report must be in CSV format
+// and include the versions, i.e., have the Key and VersionId fields in its schema.
+func ParseInventoryManifest(r io.Reader) (*InventoryManifest, error) {
+	var m InventoryManifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("invalid inventory manifest: %w", err)
+	}
+	if !strings.EqualFold(m.FileFormat, InventoryFormatCSV) {
+		return nil, fmt.Errorf("%w %q; only %s inventories can be read, so the report needs an inventory configuration in %s format",
+			ErrUnsupportedInventoryFormat, m.FileFormat, InventoryFormatCSV, InventoryFormatCSV)
+	}
+	fields := inventoryFields(m.FileSchema)
+	for _, name := range []string{"Key", "VersionId"} {
+		if !slices.Contains(fields, name) {
+			return nil, fmt.Errorf("the inventory schema has no %s field; the inventory must include all the versions", name)
+		}
+	}
+	if m.DestinationBucket == "" {
+		return nil, errors.New("the inventory manifest has no destination bucket")
+	}
+	return &m, nil
+}
+
+// DestinationBucketName returns the name of the bucket the data files are stored in.
+func (m *InventoryManifest) DestinationBucketName() string {
+	return strings.TrimPrefix(m.DestinationBucket, "arn:aws:s3:::")
+}
+
+// NewInventoryReader creates a ManifestReader reading the CSV data files of an S3 Inventory report with the given schema,
+// e.g., the FileSchema of its manifest, from r. The data files have no header row, and their keys are URL-encoded.
+// Several data files can be read at once by concatenating them after decompression.
+func NewInventoryReader(r io.Reader, schema string) (*ManifestReader, error) {
+	fields := inventoryFields(schema)
+	columns := make(map[string]int)
+	for i, name := range fields {
+		if column, ok := inventoryColumns[name]; ok {
+			columns[column] = i
+		}
+	}
+	for _, name := range []string{"key", "versionId"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("the inventory schema has no %q column", name)
+		}
+	}
+	// without a header row, the records must have as many fields as the schema, or the columns would be out of range.
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(fields)
+	return &ManifestReader{format: ManifestFormatCSV, csv: cr, columns: columns, inventory: true}, nil
+}
+
+// inventoryFields splits the schema of an S3 Inventory report, e.g., "Bucket, Key, VersionId", into its fields.
+func inventoryFields(schema string) []string {
+	fields := strings.Split(schema, ",")
+	for i, f := range fields {
+		fields[i] = strings.TrimSpace(f)
+	}
+	return fields
+}
+
+// Read reads the decompressed data files one after the other, getting each of them once the previous one is read.
+func (f *inventoryFiles) Read(p []byte) (int, error) {
+	for {
+		if f.body == nil {
+			if len(f.files) == 0 {
+				return 0, io.EOF
+			}
+			if err := f.open(f.files[0].Key); err != nil {
+				return 0, err
+			}
+			f.files = f.files[1:]
+		}
+		n, err := f.in.Read(p)
+		if errors.Is(err, io.EOF) {
+			f.Close()
+			err = nil
+		}
+		if err != nil {
+			return n, fmt.Errorf("failed to read the inventory data file %q: %w", f.key, err)
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// open gets a data file, decompressing it if its name ends with ".gz", as S3 Inventory writes them.
+func (f *inventoryFiles) open(key string) error {
+	body, err := f.s3.getObject(f.ctx, f.bucket, key)
+	if err != nil {
+		return fmt.Errorf("failed to get the inventory data file %q: %w", key, err)
+	}
+	f.key, f.body, f.in = key, body, body
+	if strings.EqualFold(path.Ext(key), ".gz") {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("failed to decompress the inventory data file %q: %w", key, err)
+		}
+		f.in = gz
+	}
+	return nil
+}
+
+// Close closes the data file being read, if any.
+func (f *inventoryFiles) Close() {
+	if f.body != nil {
+		_ = f.body.Close()
+		f.body, f.in = nil, nil
+	}
+}
@@ -0,0 +1,71 @@
+package cleanup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCleanupInventory(t *testing.T) {
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(`"test","b1","v2","true"` + "\n"))
+	w.Close()
+
+	f := &fakeS3Client{objects: map[string][]byte{
+		"inventory/test/manifest.json": []byte(`{
+			"sourceBucket": "test",
+			"destinationBucket": "arn:aws:s3:::inventory",
+			"fileFormat": "CSV",
+			"fileSchema": "Bucket, Key, VersionId, IsDeleteMarker",
+			"files": [{"key": "data/1.csv"}, {"key": "data/2.csv.gz"}]
+		}`),
+		"inventory/data/1.csv":    []byte(`"test","a%2B1","v1","false"` + "\n"),
+		"inventory/data/2.csv.gz": gz.Bytes(),
+	}}
+	c := newTestCleaner(t, f, Config{})
+
+	r, err := c.CleanupInventory(context.Background(), "s3://inventory/test/manifest.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Result{DeletedVersions: 1, DeletedDeleteMarkers: 1}); !reflect.DeepEqual(*r, want) {
+		t.Errorf("CleanupInventory() = %+v, want %+v", *r, want)
+	}
+	got := make(map[string]bool)
+	for _, keys := range f.deleteCalls {
+		for _, k := range keys {
+			got[k] = true
+		}
+	}
+	if want := map[string]bool{"a+1": true, "b1": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("deleted keys = %v, want %v", got, want)
+	}
+}
+
+func TestCleanupInventoryOfAnotherBucket(t *testing.T) {
+	f := &fakeS3Client{objects: map[string][]byte{
+		"inventory/manifest.json": []byte(`{"sourceBucket": "other", "destinationBucket": "arn:aws:s3:::inventory", "fileFormat": "CSV", "fileSchema": "Key, VersionId"}`),
+	}}
+	if _, err := newTestCleaner(t, f, Config{}).CleanupInventory(context.Background(), "s3://inventory/manifest.json"); err == nil {
+		t.Error("CleanupInventory() error = nil, want an error for the report of another bucket")
+	}
+}
+
+func TestParseInventoryManifestFormat(t *testing.T) {
+	for _, format := range []string{"ORC", "Parquet"} {
+		t.Run(format, func(t *testing.T) {
+			_, err := ParseInventoryManifest(strings.NewReader(`{"sourceBucket": "test", "destinationBucket": "arn:aws:s3:::inventory", "fileFormat": "` + format + `", "fileSchema": "Key, VersionId"}`))
+			if !errors.Is(err, ErrUnsupportedInventoryFormat) {
+				t.Fatalf("ParseInventoryManifest() error = %v, want %v", err, ErrUnsupportedInventoryFormat)
+			}
+			if !strings.Contains(err.Error(), format) {
+				t.Errorf("ParseInventoryManifest() error = %q, want it to name %s", err, format)
+			}
+		})
+	}
+}
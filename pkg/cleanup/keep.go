@@ -0,0 +1,57 @@
+package cleanup
+
+import "sort"
+
+type (
+	// versionKeeper selects the versions and delete markers to delete when keeping the newest n of each key.
+	// ListObjectVersions returns them ordered by key, so the versions of a key are complete once the next key shows up;
+	// until then, the versions of the last key of a page are held back, since they may continue on the next page.
+	versionKeeper struct {
+		n       int
+		pending []*keptObject
+	}
+
+	keptObject struct {
+		*Object
+		deleteMarker bool
+	}
+)
+
+// apply returns the versions and delete markers to delete out of the ones listed in a page and the ones held back from the previous page.
+// last tells that this is the last page, so that nothing is held back.
+func (k *versionKeeper) apply(versions, deleteMarkers []*Object, last bool) (deleteVersions, deleteDeleteMarkers []*Object) {
+	objects := k.pending
+	for _, v := range versions {
+		objects = append(objects, &keptObject{Object: v})
+	}
+	for _, d := range deleteMarkers {
+		objects = append(objects, &keptObject{Object: d, deleteMarker: true})
+	}
+	// versions and delete markers are listed separately, each ordered by key; merge them back into a single listing order.
+	sort.SliceStable(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+
+	k.pending = nil
+	for start := 0; start < len(objects); {
+		end := start + 1
+		for end < len(objects) && objects[end].Key == objects[start].Key {
+			end++
+		}
+		group := objects[start:end]
+		start = end
+
+		if end == len(objects) && !last {
+			k.pending = append([]*keptObject(nil), group...)
+			break
+		}
+
+		sort.SliceStable(group, func(i, j int) bool { return group[i].LastModified.After(group[j].LastModified) })
+		for _, o := range group[min(k.n, len(group)):] {
+			if o.deleteMarker {
+				deleteDeleteMarkers = append(deleteDeleteMarkers, o.Object)
+			} else {
+				deleteVersions = append(deleteVersions, o.Object)
+			}
+		}
+	}
+	return deleteVersions, deleteDeleteMarkers
+}
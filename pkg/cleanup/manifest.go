@@ -0,0 +1,262 @@
+package cleanup
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ManifestFormatCSV = "csv"
+const ManifestFormatJSON = "json"
+
+// ManifestFormatBatchOperations is the CSV manifest format of S3 Batch Operations jobs: bucket, URL-encoded key, and version ID,
+// without a header row. It can only be written; ManifestFormat never guesses it.
+const ManifestFormatBatchOperations = "batch-operations"
+
+// manifestCSVHeader is the header row of CSV manifests.
+var manifestCSVHeader = []string{"bucket", "key", "versionId", "isDeleteMarker", "lastModified", "size", "isLatest"}
+
+// manifestCSVRetentionHeader is appended to manifestCSVHeader by ManifestWriter.SetRetentionColumns.
+var manifestCSVRetentionHeader = []string{"retentionMode", "retainUntilDate", "legalHold"}
+
+type (
+	// ManifestEntry is a version or a delete marker recorded in a manifest.
+	ManifestEntry struct {
+		Bucket         string    `json:"bucket"`
+		Key            string    `json:"key"`
+		VersionId      string    `json:"versionId"`
+		IsDeleteMarker bool      `json:"isDeleteMarker"`
+		LastModified   time.Time `json:"lastModified"`
+		Size           int64     `json:"size"`
+		IsLatest       bool      `json:"isLatest"`
+		// RetentionMode, RetainUntilDate, and LegalHold are the Object Lock settings of the version, only recorded with Config.ListRetention.
+		RetentionMode   string     `json:"retentionMode,omitempty"`
+		RetainUntilDate *time.Time `json:"retainUntilDate,omitempty"`
+		LegalHold       bool       `json:"legalHold,omitempty"`
+	}
+
+	// ManifestWriter writes manifest entries in CSV or JSON lines format.
+	ManifestWriter struct {
+		format string
+		csv    *csv.Writer
+		json   *json.Encoder
+		header bool
+		// retention adds the retention columns to CSV manifests.
+		retention bool
+	}
+
+	// ManifestReader reads manifest entries written by ManifestWriter.
+	// CSV manifests must have a header row with at least the "key" and "versionId" columns; the other columns are optional.
+	ManifestReader struct {
+		format  string
+		csv     *csv.Reader
+		json    *json.Decoder
+		columns map[string]int
+		entries int
+		// inventory tells that the records are those of an S3 Inventory report, whose columns are preset.
+		inventory bool
+	}
+)
+
+// ManifestFormat guesses the manifest format from the file name: CSV for ".csv", JSON lines otherwise.
+// A ".gz" suffix for compression is ignored, e.g., "manifest.csv.gz" is CSV.
+func ManifestFormat(name string) string {
+	if ext := filepath.Ext(name); strings.EqualFold(ext, ".gz") {
+		name = strings.TrimSuffix(name, ext)
+	}
+	if strings.EqualFold(filepath.Ext(name), ".csv") {
+		return ManifestFormatCSV
+	}
+	return ManifestFormatJSON
+}
+
+// NewManifestWriter creates a ManifestWriter writing to w in the given format.
+func NewManifestWriter(w io.Writer, format string) (*ManifestWriter, error) {
+	switch format {
+	case ManifestFormatCSV, ManifestFormatBatchOperations:
+		return &ManifestWriter{format: format, csv: csv.NewWriter(w)}, nil
+	case ManifestFormatJSON:
+		return &ManifestWriter{format: format, json: json.NewEncoder(w)}, nil
+	default:
+		return nil, fmt.Errorf("unknown manifest format: %q", format)
+	}
+}
+
+// SetRetentionColumns adds the retentionMode, retainUntilDate, and legalHold columns to CSV manifests, e.g., with Config.ListRetention.
+// It must be called before the first entry is written. JSON manifests include the retention of the entries that have one regardless.
+func (w *ManifestWriter) SetRetentionColumns(on bool) {
+	w.retention = on
+}
+
+// Write writes an entry to the manifest.
+func (w *ManifestWriter) Write(e *ManifestEntry) error {
+	switch w.format {
+	case ManifestFormatJSON:
+		return w.json.Encode(e)
+	case ManifestFormatBatchOperations:
+		return w.csv.Write([]string{e.Bucket, url.QueryEscape(e.Key), e.VersionId})
+	}
+
+	if !w.header {
+		header := manifestCSVHeader
+		if w.retention {
+			header = append(slices.Clip(header), manifestCSVRetentionHeader...)
+		}
+		if err := w.csv.Write(header); err != nil {
+			return err
+		}
+		w.header = true
+	}
+	record := []string{
+		e.Bucket,
+		e.Key,
+		e.VersionId,
+		strconv.FormatBool(e.IsDeleteMarker),
+		e.LastModified.Format(time.RFC3339),
+		strconv.FormatInt(e.Size, 10),
+		strconv.FormatBool(e.IsLatest),
+	}
+	if w.retention {
+		var retainUntil string
+		if e.RetainUntilDate != nil {
+			retainUntil = e.RetainUntilDate.Format(time.RFC3339)
+		}
+		record = append(record, e.RetentionMode, retainUntil, strconv.FormatBool(e.LegalHold))
+	}
+	return w.csv.Write(record)
+}
+
+// Flush writes any buffered data to the underlying writer.
+func (w *ManifestWriter) Flush() error {
+	if w.format == ManifestFormatJSON {
+		return nil
+	}
+	w.csv.Flush()
+	return w.csv.Error()
+}
+
+// NewManifestReader creates a ManifestReader reading from r in the given format.
+func NewManifestReader(r io.Reader, format string) (*ManifestReader, error) {
+	switch format {
+	case ManifestFormatCSV:
+		return &ManifestReader{format: format, csv: csv.NewReader(r)}, nil
+	case ManifestFormatJSON:
+		return &ManifestReader{format: format, json: json.NewDecoder(r)}, nil
+	default:
+		return nil, fmt.Errorf("unknown manifest format: %q", format)
+	}
+}
+
+// Read reads the next entry from the manifest. It returns io.EOF when there are no more entries.
+func (r *ManifestReader) Read() (*ManifestEntry, error) {
+	r.entries++
+	if r.format == ManifestFormatJSON {
+		var e ManifestEntry
+		if err := r.json.Decode(&e); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, io.EOF
+			}
+			return nil, fmt.Errorf("entry %d: %w", r.entries, err)
+		}
+		return &e, nil
+	}
+
+	if r.columns == nil {
+		if err := r.readHeader(); err != nil {
+			return nil, err
+		}
+	}
+	record, err := r.csv.Read()
+	if err != nil {
+		return nil, err
+	}
+	return r.parseRecord(record)
+}
+
+func (r *ManifestReader) readHeader() error {
+	header, err := r.csv.Read()
+	if errors.Is(err, io.EOF) {
+		return io.EOF
+	}
+	if err != nil {
+		return err
+	}
+	r.columns = make(map[string]int, len(header))
+	for i, name := range header {
+		r.columns[strings.TrimSpace(name)] = i
+	}
+	for _, name := range []string{"key", "versionId"} {
+		if _, ok := r.columns[name]; !ok {
+			return fmt.Errorf("the header has no %q column", name)
+		}
+	}
+	return nil
+}
+
+func (r *ManifestReader) parseRecord(record []string) (*ManifestEntry, error) {
+	line, _ := r.csv.FieldPos(0)
+	field := func(name string) string {
+		if i, ok := r.columns[name]; ok {
+			return record[i]
+		}
+		return ""
+	}
+
+	e := &ManifestEntry{
+		Bucket:    field("bucket"),
+		Key:       field("key"),
+		VersionId: field("versionId"),
+	}
+	var err error
+	if r.inventory {
+		if e.Key, err = url.QueryUnescape(e.Key); err != nil {
+			return nil, fmt.Errorf("line %d: invalid key: %w", line, err)
+		}
+		// the inventory leaves the version ID of null versions, e.g., those written before versioning was enabled, empty.
+		if e.VersionId == "" {
+			e.VersionId = nullVersionId
+		}
+	}
+	if v := field("isDeleteMarker"); v != "" {
+		if e.IsDeleteMarker, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("line %d: invalid isDeleteMarker: %w", line, err)
+		}
+	}
+	if v := field("lastModified"); v != "" {
+		if e.LastModified, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, fmt.Errorf("line %d: invalid lastModified: %w", line, err)
+		}
+	}
+	if v := field("size"); v != "" {
+		if e.Size, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, fmt.Errorf("line %d: invalid size: %w", line, err)
+		}
+	}
+	if v := field("isLatest"); v != "" {
+		if e.IsLatest, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("line %d: invalid isLatest: %w", line, err)
+		}
+	}
+	e.RetentionMode = field("retentionMode")
+	if v := field("retainUntilDate"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid retainUntilDate: %w", line, err)
+		}
+		e.RetainUntilDate = &t
+	}
+	if v := field("legalHold"); v != "" {
+		if e.LegalHold, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("line %d: invalid legalHold: %w", line, err)
+		}
+	}
+	return e, nil
+}
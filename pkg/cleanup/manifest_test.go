@@ -0,0 +1,83 @@
+package cleanup
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestInventoryReaderDecodesKeys(t *testing.T) {
+	var csv strings.Builder
+	for _, encoded := range encodedKeys {
+		csv.WriteString(`"test","` + encoded + `","v1","false"` + "\n")
+	}
+	r, err := NewInventoryReader(strings.NewReader(csv.String()), "Bucket, Key, VersionId, IsDeleteMarker")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]bool)
+	for {
+		e, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[e.Key] = true
+	}
+	for key := range encodedKeys {
+		if !got[key] {
+			t.Errorf("key %q wasn't read, got %v", key, got)
+		}
+	}
+}
+
+func TestManifestReaderKeepsKeys(t *testing.T) {
+	// unlike inventory reports, the manifests written by ManifestWriter hold the keys as they are.
+	r, err := NewManifestReader(strings.NewReader("key,versionId\n\"a+b%20c d\",v1\n"), ManifestFormatCSV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := r.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Key != "a+b%20c d" {
+		t.Errorf("key = %q, want %q", e.Key, "a+b%20c d")
+	}
+}
+
+func TestInventoryReaderFieldCount(t *testing.T) {
+	tests := []struct {
+		name string
+		csv  string
+	}{
+		{name: "short first record", csv: "\"test\",\"k1\"\n"},
+		{name: "short later record", csv: "\"test\",\"k1\",\"v1\",\"false\"\n\"test\",\"k2\"\n"},
+		{name: "long record", csv: "\"test\",\"k1\",\"v1\",\"false\",\"extra\"\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewInventoryReader(strings.NewReader(tt.csv), "Bucket, Key, VersionId, IsDeleteMarker")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for {
+				_, err := r.Read()
+				if errors.Is(err, io.EOF) {
+					t.Fatal("Read() reached the end without reporting the wrong number of fields")
+				}
+				if err != nil {
+					if !errors.Is(err, csv.ErrFieldCount) {
+						t.Errorf("Read() error = %v, want %v", err, csv.ErrFieldCount)
+					}
+					return
+				}
+			}
+		})
+	}
+}
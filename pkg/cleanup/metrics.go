@@ -0,0 +1,58 @@
+package cleanup
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// Metrics accumulates the number of S3 API calls and the time spent in them, retries included.
+	// It's safe for concurrent use and can be shared among Cleaners.
+	Metrics struct {
+		mu   sync.Mutex
+		apis map[string]*APIMetrics
+	}
+
+	// APIMetrics is the number of calls to an S3 API and the cumulative time spent in them.
+	APIMetrics struct {
+		API      string
+		Calls    int64
+		Duration time.Duration
+	}
+)
+
+// NewMetrics creates an empty Metrics.
+func NewMetrics() *Metrics {
+	return &Metrics{apis: make(map[string]*APIMetrics)}
+}
+
+// observe records a call to api that started at start. It does nothing on a nil Metrics.
+func (m *Metrics) observe(api string, start time.Time) {
+	if m == nil {
+		return
+	}
+	d := time.Since(start)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a, ok := m.apis[api]
+	if !ok {
+		a = &APIMetrics{API: api}
+		m.apis[api] = a
+	}
+	a.Calls++
+	a.Duration += d
+}
+
+// APIs returns the metrics of each called API, sorted by API name.
+func (m *Metrics) APIs() []APIMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	apis := make([]APIMetrics, 0, len(m.apis))
+	for _, a := range m.apis {
+		apis = append(apis, *a)
+	}
+	sort.Slice(apis, func(i, j int) bool { return apis[i].API < apis[j].API })
+	return apis
+}
@@ -0,0 +1,73 @@
+package cleanup
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// upload is an incomplete multipart upload.
+type upload struct {
+	Key       string
+	UploadId  string
+	Initiated time.Time
+}
+
+// abortUploads aborts the incomplete multipart uploads of the bucket under the prefix that are old enough.
+// Their parts aren't listed by ListObjectVersions, yet they're billed as storage until they're aborted.
+func (c *Cleaner) abortUploads(ctx context.Context) (int, error) {
+	var (
+		aborted            int
+		nextKeyMarker      *string
+		nextUploadIdMarker *string
+	)
+
+	cutoff := c.now().Add(-c.olderThan)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return aborted, err
+		}
+
+		uploads, keyMarker, uploadIdMarker, err := c.listMultipartUploads(ctx, c.bucket, c.prefix, nextKeyMarker, nextUploadIdMarker)
+		if err != nil {
+			return aborted, fmt.Errorf("failed to list multipart uploads: %w", err)
+		}
+		nextKeyMarker, nextUploadIdMarker = keyMarker, uploadIdMarker
+		c.logger.Info("Retrieved incomplete multipart uploads", "uploads", len(uploads))
+
+		for _, u := range uploads {
+			if !c.shouldAbort(u, cutoff) {
+				continue
+			}
+
+			if c.dryRun {
+				c.logger.Info("Would abort multipart upload", "key", u.Key, "uploadId", u.UploadId)
+				aborted++
+				continue
+			}
+			if err := c.abortMultipartUpload(ctx, c.bucket, u.Key, u.UploadId); err != nil {
+				return aborted, fmt.Errorf("failed to abort multipart upload: %w", err)
+			}
+			c.logger.Info("Aborted multipart upload", "key", u.Key, "uploadId", u.UploadId)
+			aborted++
+		}
+
+		if nextKeyMarker == nil && nextUploadIdMarker == nil {
+			return aborted, nil
+		}
+	}
+}
+
+// shouldAbort reports whether the upload is under the shards, if any, and within the age filters, against its initiation time.
+// The other filters are about versions, e.g., -keep-latest or the key patterns, or would abort a random part of the uploads,
+// as -sample-rate would, so they don't apply; the uploads are listed without the delimiter either, i.e., under the whole prefix.
+func (c *Cleaner) shouldAbort(u *upload, cutoff time.Time) bool {
+	if !c.inShards(u.Key) {
+		return false
+	}
+	if c.olderThan > 0 && u.Initiated.After(cutoff) {
+		return false
+	}
+	return (c.since.IsZero() || !u.Initiated.Before(c.since)) && (c.until.IsZero() || u.Initiated.Before(c.until))
+}
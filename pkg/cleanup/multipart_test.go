@@ -0,0 +1,59 @@
+package cleanup
+
+import (
+	"context"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestAbortUploads(t *testing.T) {
+	now := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	uploads := []*upload{
+		{Key: "logs/old", UploadId: "u1", Initiated: now.Add(-72 * time.Hour)},
+		{Key: "logs/new", UploadId: "u2", Initiated: now.Add(-time.Hour)},
+		{Key: "logs/2024/nested", UploadId: "u3", Initiated: now.Add(-72 * time.Hour)},
+		{Key: "data/old", UploadId: "u4", Initiated: now.Add(-72 * time.Hour)},
+	}
+
+	tests := []struct {
+		name string
+		cfg  Config
+		want []string
+	}{
+		{name: "prefix", cfg: Config{Prefix: "logs/"}, want: []string{"logs/old", "logs/new", "logs/2024/nested"}},
+		{name: "older than", cfg: Config{OlderThan: 24 * time.Hour}, want: []string{"logs/old", "logs/2024/nested", "data/old"}},
+		{name: "until", cfg: Config{Until: now.Add(-2 * time.Hour)}, want: []string{"logs/old", "logs/2024/nested", "data/old"}},
+		{name: "since", cfg: Config{Since: now.Add(-2 * time.Hour)}, want: []string{"logs/new"}},
+		{
+			// the version filters and the delimiter don't apply to the uploads.
+			name: "other filters",
+			cfg: Config{
+				Prefix:     "logs/",
+				Delimiter:  "/",
+				Include:    regexp.MustCompile(`^none$`),
+				KeepLatest: true,
+				SampleRate: 0.000001,
+				DenyList:   []string{"logs/"},
+			},
+			want: []string{"logs/old", "logs/new", "logs/2024/nested"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeS3Client{uploads: uploads}
+			c := newTestCleaner(t, f, tt.cfg)
+			c.now = func() time.Time { return now }
+
+			n, err := c.abortUploads(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(f.aborted, tt.want) || n != len(tt.want) {
+				t.Errorf("abortUploads() = %d aborting %v, want %v", n, f.aborted, tt.want)
+			}
+		})
+	}
+}
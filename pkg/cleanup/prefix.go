@@ -0,0 +1,78 @@
+package cleanup
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+type (
+	// PrefixStats is the number of versions and delete markers deleted under a top-level prefix, and the total size of the versions.
+	// The top-level prefix of a key runs up to its first slash, included; keys without a slash have an empty prefix.
+	PrefixStats struct {
+		Prefix        string `json:"prefix"`
+		Versions      int    `json:"versions"`
+		DeleteMarkers int    `json:"deleteMarkers"`
+		Bytes         int64  `json:"bytes"`
+	}
+
+	// prefixCounter accumulates the PrefixStats of the deleted objects. It's safe for concurrent use by the workers.
+	prefixCounter struct {
+		mu       sync.Mutex
+		prefixes map[string]*PrefixStats
+	}
+)
+
+// add counts the deleted objects of a batch. freed tells whether the sizes of the versions count, as in Result.FreedBytes.
+func (p *prefixCounter) add(objects []*Object, deleteMarkers, freed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.prefixes == nil {
+		p.prefixes = make(map[string]*PrefixStats)
+	}
+	for _, o := range objects {
+		prefix := topLevelPrefix(o.Key)
+		s, ok := p.prefixes[prefix]
+		if !ok {
+			s = &PrefixStats{Prefix: prefix}
+			p.prefixes[prefix] = s
+		}
+		if deleteMarkers {
+			s.DeleteMarkers++
+			continue
+		}
+		s.Versions++
+		if freed {
+			s.Bytes += o.Size
+		}
+	}
+}
+
+// stats returns the accumulated stats, the largest first by bytes, then by number of objects, then by prefix.
+func (p *prefixCounter) stats() []PrefixStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := make([]PrefixStats, 0, len(p.prefixes))
+	for _, s := range p.prefixes {
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		a, b := stats[i], stats[j]
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		if na, nb := a.Versions+a.DeleteMarkers, b.Versions+b.DeleteMarkers; na != nb {
+			return na > nb
+		}
+		return a.Prefix < b.Prefix
+	})
+	return stats
+}
+
+// topLevelPrefix returns the key up to its first slash, included, or an empty string if it has none.
+func topLevelPrefix(key string) string {
+	if i := strings.IndexByte(key, '/'); i >= 0 {
+		return key[:i+1]
+	}
+	return ""
+}
@@ -0,0 +1,22 @@
+package cleanup
+
+import (
+	"context"
+	"fmt"
+)
+
+// addRetention records the Object Lock retention and legal hold of the version of a manifest entry.
+func (c *Cleaner) addRetention(ctx context.Context, e *ManifestEntry) error {
+	mode, retainUntil, err := c.getObjectRetention(ctx, c.bucket, e.Key, e.VersionId)
+	if err != nil {
+		return fmt.Errorf("failed to get the retention of key %q version %q: %w", e.Key, e.VersionId, err)
+	}
+	if mode != "" {
+		e.RetentionMode = mode
+		e.RetainUntilDate = &retainUntil
+	}
+	if e.LegalHold, err = c.getObjectLegalHold(ctx, c.bucket, e.Key, e.VersionId); err != nil {
+		return fmt.Errorf("failed to get the legal hold of key %q version %q: %w", e.Key, e.VersionId, err)
+	}
+	return nil
+}
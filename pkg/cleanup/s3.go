@@ -0,0 +1,955 @@
+package cleanup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"golang.org/x/time/rate"
+)
+
+// baseRetryBackoff and maxRetryBackoff bound the exponential backoff between retried API calls.
+const baseRetryBackoff = 100 * time.Millisecond
+const maxRetryBackoff = 20 * time.Second
+
+// ErrMFARequired is reported when the bucket has MFA Delete enabled and Config.MFA isn't set.
+var ErrMFARequired = errors.New("the bucket has MFA Delete enabled; an MFA device serial number and token code are required")
+
+// ErrKMSPermission is reported when DeleteObjects fails on objects with a KMS-related error,
+// which usually means that they're encrypted with SSE-KMS and the caller lacks permissions on the key.
+var ErrKMSPermission = errors.New("the objects may be encrypted with a KMS key the caller lacks the kms:Decrypt or kms:GenerateDataKey permission for")
+
+// ErrObjectsNotDeleted is reported when DeleteObjects fails to delete some of the objects while deleting the others.
+var ErrObjectsNotDeleted = errors.New("some objects couldn't be deleted")
+
+// ErrBucketNotFound is reported when the bucket doesn't exist.
+var ErrBucketNotFound = errors.New("the bucket doesn't exist")
+
+// ErrWrongRegion is reported when the bucket is in another region than the client's.
+var ErrWrongRegion = errors.New("the bucket is in another region")
+
+// WrongRegionError is the ErrWrongRegion reported when S3 tells the region of the bucket, which can be extracted with errors.As.
+type WrongRegionError struct {
+	// Region is the region of the bucket.
+	Region string
+	err    error
+}
+
+func (e *WrongRegionError) Error() string {
+	return fmt.Sprintf("%v: %v: %s", e.err, ErrWrongRegion, e.Region)
+}
+
+func (e *WrongRegionError) Unwrap() error {
+	return e.err
+}
+
+// Is makes errors.Is match ErrWrongRegion.
+func (e *WrongRegionError) Is(target error) bool {
+	return target == ErrWrongRegion
+}
+
+// ErrAccessDenied is reported when S3 denies access to the bucket, which also happens for buckets that don't exist
+// with credentials lacking the s3:ListBucket permission.
+var ErrAccessDenied = errors.New("access to the bucket is denied")
+
+// ErrBucketNotEmpty is reported by DeleteBucket when versions or delete markers remain in the bucket.
+var ErrBucketNotEmpty = errors.New("the bucket isn't empty")
+
+type (
+	// S3API is the subset of the S3 client used by a Cleaner. *s3.Client satisfies it.
+	S3API interface {
+		ListObjectVersions(ctx context.Context, params *s3.ListObjectVersionsInput, optFns ...func(*s3.Options)) (*s3.ListObjectVersionsOutput, error)
+		DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error)
+		HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
+		GetBucketVersioning(ctx context.Context, params *s3.GetBucketVersioningInput, optFns ...func(*s3.Options)) (*s3.GetBucketVersioningOutput, error)
+		GetObjectTagging(ctx context.Context, params *s3.GetObjectTaggingInput, optFns ...func(*s3.Options)) (*s3.GetObjectTaggingOutput, error)
+		GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+		GetObjectLockConfiguration(ctx context.Context, params *s3.GetObjectLockConfigurationInput, optFns ...func(*s3.Options)) (*s3.GetObjectLockConfigurationOutput, error)
+		GetObjectRetention(ctx context.Context, params *s3.GetObjectRetentionInput, optFns ...func(*s3.Options)) (*s3.GetObjectRetentionOutput, error)
+		GetObjectLegalHold(ctx context.Context, params *s3.GetObjectLegalHoldInput, optFns ...func(*s3.Options)) (*s3.GetObjectLegalHoldOutput, error)
+		ListMultipartUploads(ctx context.Context, params *s3.ListMultipartUploadsInput, optFns ...func(*s3.Options)) (*s3.ListMultipartUploadsOutput, error)
+		AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+		DeleteBucket(ctx context.Context, params *s3.DeleteBucketInput, optFns ...func(*s3.Options)) (*s3.DeleteBucketOutput, error)
+		ListBuckets(ctx context.Context, params *s3.ListBucketsInput, optFns ...func(*s3.Options)) (*s3.ListBucketsOutput, error)
+	}
+
+	s3cli struct {
+		s3API      S3API
+		maxRetries int
+		// apiTimeout bounds each API call attempt when nonzero.
+		apiTimeout time.Duration
+
+		// delimiter is passed to ListObjectVersions when set.
+		delimiter string
+
+		// deleteLimiter throttles DeleteObjects calls when set.
+		deleteLimiter *rate.Limiter
+		// metrics records the API calls when set.
+		metrics *Metrics
+
+		// bypassGovernance sets BypassGovernanceRetention on DeleteObjects calls.
+		// it has no effect on objects locked in compliance mode.
+		bypassGovernance bool
+		// mfa is the "<serial> <token>" value sent with DeleteObjects calls when set.
+		mfa string
+		// requesterPays acknowledges the charges of requester-pays buckets on the calls that support it.
+		requesterPays bool
+		// addDeleteMarkers deletes the objects by key only, which adds delete markers in front of them instead of deleting their versions.
+		addDeleteMarkers bool
+		// bucketOwner is the account ID the bucket must belong to when set; S3 rejects the calls with 403 otherwise.
+		bucketOwner string
+		// ignoreNotFound drops the NoSuchKey and NoSuchVersion failures of DeleteObjects.
+		ignoreNotFound bool
+
+		logger *slog.Logger
+	}
+
+	// deleteObjectsError reports the objects that DeleteObjects failed to delete.
+	deleteObjectsError struct {
+		failures []*deleteFailure
+	}
+
+	// objectBody is the body of a GetObject response, which ends the context of the call once closed.
+	objectBody struct {
+		io.ReadCloser
+		cancel context.CancelFunc
+	}
+
+	deleteFailure struct {
+		*Object
+
+		Code    string
+		Message string
+	}
+)
+
+func (e *deleteObjectsError) Error() string {
+	msgs := make([]string, len(e.failures))
+	for i, f := range e.failures {
+		msgs[i] = fmt.Sprintf("key=%s versionId=%s: %s: %s", f.Key, f.VersionId, f.Code, f.Message)
+	}
+	return fmt.Sprintf("failed to delete %d objects: %s", len(e.failures), strings.Join(msgs, "; "))
+}
+
+func (b *objectBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// Is makes errors.Is match ErrObjectsNotDeleted.
+func (e *deleteObjectsError) Is(target error) bool {
+	return target == ErrObjectsNotDeleted
+}
+
+// newS3cli creates the S3 client of a Cleaner out of its configuration.
+func newS3cli(api S3API, cfg Config, logger *slog.Logger) *s3cli {
+	return &s3cli{
+		s3API:         api,
+		maxRetries:    cfg.MaxRetries,
+		apiTimeout:    cfg.APITimeout,
+		delimiter:     cfg.Delimiter,
+		deleteLimiter: cfg.DeleteLimiter,
+		metrics:       cfg.Metrics,
+		logger:        logger,
+
+		bypassGovernance: cfg.BypassGovernance,
+		mfa:              cfg.MFA,
+		requesterPays:    cfg.RequesterPays,
+		addDeleteMarkers: cfg.CurrentOnly,
+		bucketOwner:      cfg.ExpectedBucketOwner,
+		ignoreNotFound:   cfg.IgnoreNotFound,
+	}
+}
+
+func (c *s3cli) listBuckets(ctx context.Context) ([]string, error) {
+	var out *s3.ListBucketsOutput
+	err := c.withRetry(ctx, "ListBuckets", func() (err error) {
+		ctx, cancel := c.apiContext(ctx)
+		defer cancel()
+		defer c.metrics.observe("ListBuckets", time.Now())
+		out, err = c.s3API.ListBuckets(ctx, &s3.ListBucketsInput{})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ListBuckets API error: %w", err)
+	}
+
+	names := make([]string, len(out.Buckets))
+	for i, b := range out.Buckets {
+		names[i] = aws.ToString(b.Name)
+	}
+	return names, nil
+}
+
+// headBucket checks that the bucket is accessible in the client's region and returns its region.
+func (c *s3cli) headBucket(ctx context.Context, bucket string) (string, error) {
+	var out *s3.HeadBucketOutput
+	err := c.withRetry(ctx, "HeadBucket", func() (err error) {
+		ctx, cancel := c.apiContext(ctx)
+		defer cancel()
+		defer c.metrics.observe("HeadBucket", time.Now())
+		out, err = c.s3API.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(bucket), ExpectedBucketOwner: c.expectedBucketOwner()})
+		return err
+	})
+	if err == nil {
+		return aws.ToString(out.BucketRegion), nil
+	}
+
+	// HeadBucket responses have no body, so the status code is all there is to tell the cause.
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		switch respErr.HTTPStatusCode() {
+		case http.StatusNotFound:
+			return "", fmt.Errorf("HeadBucket API error: %w: %w", err, ErrBucketNotFound)
+		case http.StatusForbidden:
+			return "", fmt.Errorf("HeadBucket API error: %w: %w", err, ErrAccessDenied)
+		case http.StatusMovedPermanently:
+			if region := respErr.Response.Header.Get("X-Amz-Bucket-Region"); region != "" {
+				return region, fmt.Errorf("HeadBucket API error: %w", &WrongRegionError{Region: region, err: err})
+			}
+			return "", fmt.Errorf("HeadBucket API error: %w: %w", err, ErrWrongRegion)
+		}
+	}
+	return "", fmt.Errorf("HeadBucket API error: %w", err)
+}
+
+func (c *s3cli) getBucketVersioning(ctx context.Context, bucket string) (string, error) {
+	var out *s3.GetBucketVersioningOutput
+	err := c.withRetry(ctx, "GetBucketVersioning", func() (err error) {
+		ctx, cancel := c.apiContext(ctx)
+		defer cancel()
+		defer c.metrics.observe("GetBucketVersioning", time.Now())
+		out, err = c.s3API.GetBucketVersioning(ctx, &s3.GetBucketVersioningInput{Bucket: aws.String(bucket), ExpectedBucketOwner: c.expectedBucketOwner()})
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("GetBucketVersioning API error: %w", err)
+	}
+	return string(out.Status), nil
+}
+
+func (c *s3cli) getObjectTagging(ctx context.Context, bucket, key, versionId string) (map[string]string, error) {
+	var out *s3.GetObjectTaggingOutput
+	err := c.withRetry(ctx, "GetObjectTagging", func() (err error) {
+		ctx, cancel := c.apiContext(ctx)
+		defer cancel()
+		defer c.metrics.observe("GetObjectTagging", time.Now())
+		out, err = c.s3API.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+			Bucket:       aws.String(bucket),
+			Key:          aws.String(key),
+			VersionId:    aws.String(versionId),
+			RequestPayer: c.requestPayer(),
+
+			ExpectedBucketOwner: c.expectedBucketOwner(),
+		})
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("GetObjectTagging API error: %w", err)
+	}
+
+	tags := make(map[string]string, len(out.TagSet))
+	for _, t := range out.TagSet {
+		tags[aws.ToString(t.Key)] = aws.ToString(t.Value)
+	}
+	return tags, nil
+}
+
+// getObject gets the body of the object, which the caller must close.
+// The API timeout bounds getting the response, but not reading the body, which may take longer for a large object.
+func (c *s3cli) getObject(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	var out *s3.GetObjectOutput
+	err := c.withRetry(ctx, "GetObject", func() (err error) {
+		ctx, cancel := context.WithCancel(ctx)
+		if c.apiTimeout > 0 {
+			t := time.AfterFunc(c.apiTimeout, cancel)
+			defer t.Stop()
+		}
+		defer c.metrics.observe("GetObject", time.Now())
+		out, err = c.s3API.GetObject(ctx, &s3.GetObjectInput{
+			Bucket:       aws.String(bucket),
+			Key:          aws.String(key),
+			RequestPayer: c.requestPayer(),
+
+			ExpectedBucketOwner: c.expectedBucketOwner(),
+		})
+		if err != nil {
+			cancel()
+			return err
+		}
+		out.Body = &objectBody{ReadCloser: out.Body, cancel: cancel}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("GetObject API error: %w", err)
+	}
+	return out.Body, nil
+}
+
+func (c *s3cli) getObjectLockEnabled(ctx context.Context, bucket string) (bool, error) {
+	var out *s3.GetObjectLockConfigurationOutput
+	err := c.withRetry(ctx, "GetObjectLockConfiguration", func() (err error) {
+		ctx, cancel := c.apiContext(ctx)
+		defer cancel()
+		defer c.metrics.observe("GetObjectLockConfiguration", time.Now())
+		out, err = c.s3API.GetObjectLockConfiguration(ctx, &s3.GetObjectLockConfigurationInput{Bucket: aws.String(bucket), ExpectedBucketOwner: c.expectedBucketOwner()})
+		return err
+	})
+	if hasErrorCode(err, "ObjectLockConfigurationNotFoundError") {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("GetObjectLockConfiguration API error: %w", err)
+	}
+	return out.ObjectLockConfiguration != nil && out.ObjectLockConfiguration.ObjectLockEnabled == types.ObjectLockEnabledEnabled, nil
+}
+
+func (c *s3cli) getObjectRetention(ctx context.Context, bucket, key, versionId string) (string, time.Time, error) {
+	var out *s3.GetObjectRetentionOutput
+	err := c.withRetry(ctx, "GetObjectRetention", func() (err error) {
+		ctx, cancel := c.apiContext(ctx)
+		defer cancel()
+		defer c.metrics.observe("GetObjectRetention", time.Now())
+		out, err = c.s3API.GetObjectRetention(ctx, &s3.GetObjectRetentionInput{
+			Bucket:       aws.String(bucket),
+			Key:          aws.String(key),
+			VersionId:    aws.String(versionId),
+			RequestPayer: c.requestPayer(),
+
+			ExpectedBucketOwner: c.expectedBucketOwner(),
+		})
+		return err
+	})
+	// S3 reports a version without retention as an error.
+	if hasErrorCode(err, "NoSuchObjectLockConfiguration") {
+		return "", time.Time{}, nil
+	}
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("GetObjectRetention API error: %w", err)
+	}
+	if out.Retention == nil {
+		return "", time.Time{}, nil
+	}
+	return string(out.Retention.Mode), aws.ToTime(out.Retention.RetainUntilDate), nil
+}
+
+func (c *s3cli) getObjectLegalHold(ctx context.Context, bucket, key, versionId string) (bool, error) {
+	var out *s3.GetObjectLegalHoldOutput
+	err := c.withRetry(ctx, "GetObjectLegalHold", func() (err error) {
+		ctx, cancel := c.apiContext(ctx)
+		defer cancel()
+		defer c.metrics.observe("GetObjectLegalHold", time.Now())
+		out, err = c.s3API.GetObjectLegalHold(ctx, &s3.GetObjectLegalHoldInput{
+			Bucket:       aws.String(bucket),
+			Key:          aws.String(key),
+			VersionId:    aws.String(versionId),
+			RequestPayer: c.requestPayer(),
+
+			ExpectedBucketOwner: c.expectedBucketOwner(),
+		})
+		return err
+	})
+	// like for the retention, S3 reports a version that never had a legal hold as an error.
+	if hasErrorCode(err, "NoSuchObjectLockConfiguration") {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("GetObjectLegalHold API error: %w", err)
+	}
+	return out.LegalHold != nil && out.LegalHold.Status == types.ObjectLockLegalHoldStatusOn, nil
+}
+
+func (c *s3cli) listObjectVersions(ctx context.Context, bucket, prefix string, maxKeys int64, keyMarker, versionIdMarker *string) (versions []*Object, deleteMarkers []*Object, nextKeyMarker, nextVersionIdMarker *string, err error) {
+	out, err := c.listObjectVersionsPage(ctx, bucket, prefix, maxKeys, keyMarker, versionIdMarker, true)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	// S3 always sets the key and the version ID, "null" for objects written before versioning was enabled,
+	// but an entry without them can't be deleted, so it's skipped rather than allowed to crash the run.
+	for _, v := range out.Versions {
+		if v.Key == nil || v.VersionId == nil {
+			c.logger.Warn("Skipped version without a key or a version ID", "key", aws.ToString(v.Key), "versionId", aws.ToString(v.VersionId))
+			continue
+		}
+		versions = append(versions, &Object{
+			Key:          *v.Key,
+			VersionId:    *v.VersionId,
+			LastModified: aws.ToTime(v.LastModified),
+			Size:         aws.ToInt64(v.Size),
+			IsLatest:     aws.ToBool(v.IsLatest),
+		})
+	}
+
+	for _, d := range out.DeleteMarkers {
+		if d.Key == nil || d.VersionId == nil {
+			c.logger.Warn("Skipped delete marker without a key or a version ID", "key", aws.ToString(d.Key), "versionId", aws.ToString(d.VersionId))
+			continue
+		}
+		deleteMarkers = append(deleteMarkers, &Object{
+			Key:          *d.Key,
+			VersionId:    *d.VersionId,
+			LastModified: aws.ToTime(d.LastModified),
+			IsLatest:     aws.ToBool(d.IsLatest),
+		})
+	}
+
+	return versions, deleteMarkers, out.NextKeyMarker, out.NextVersionIdMarker, nil
+}
+
+// countObjectVersions counts a page of versions and delete markers like listObjectVersions lists it, skipping the same entries,
+// but without building an Object for each of them or decoding their keys.
+func (c *s3cli) countObjectVersions(ctx context.Context, bucket, prefix string, maxKeys int64, keyMarker, versionIdMarker *string) (counts objectCounts, nextKeyMarker, nextVersionIdMarker *string, err error) {
+	out, err := c.listObjectVersionsPage(ctx, bucket, prefix, maxKeys, keyMarker, versionIdMarker, false)
+	if err != nil {
+		return objectCounts{}, nil, nil, err
+	}
+
+	for _, v := range out.Versions {
+		if v.Key == nil || v.VersionId == nil {
+			c.logger.Warn("Skipped version without a key or a version ID", "key", aws.ToString(v.Key), "versionId", aws.ToString(v.VersionId))
+			continue
+		}
+		counts.versions++
+		counts.bytes += aws.ToInt64(v.Size)
+	}
+	for _, d := range out.DeleteMarkers {
+		if d.Key == nil || d.VersionId == nil {
+			c.logger.Warn("Skipped delete marker without a key or a version ID", "key", aws.ToString(d.Key), "versionId", aws.ToString(d.VersionId))
+			continue
+		}
+		counts.deleteMarkers++
+	}
+
+	return counts, out.NextKeyMarker, out.NextVersionIdMarker, nil
+}
+
+// firstObjectVersion returns the key and version ID of the first version or delete marker of the bucket, if any.
+// Unlike listObjectVersions, it lists the whole bucket without the delimiter, so that nothing is rolled up into a common prefix;
+// a common prefix is still taken as something remaining, in case an S3-compatible service returns one anyway.
+func (c *s3cli) firstObjectVersion(ctx context.Context, bucket string) (key, versionId string, found bool, err error) {
+	var out *s3.ListObjectVersionsOutput
+	err = c.withRetry(ctx, "ListObjectVersions", func() (err error) {
+		ctx, cancel := c.apiContext(ctx)
+		defer cancel()
+		defer c.metrics.observe("ListObjectVersions", time.Now())
+		out, err = c.s3API.ListObjectVersions(ctx, &s3.ListObjectVersionsInput{
+			Bucket:       aws.String(bucket),
+			MaxKeys:      aws.Int32(1),
+			RequestPayer: c.requestPayer(),
+
+			ExpectedBucketOwner: c.expectedBucketOwner(),
+		})
+		return err
+	})
+	if err != nil {
+		if berr := bucketError(err); berr != nil {
+			return "", "", false, fmt.Errorf("ListObjectVersions API error: %w: %w", err, berr)
+		}
+		return "", "", false, fmt.Errorf("ListObjectVersions API error: %w", err)
+	}
+
+	switch {
+	case len(out.Versions) > 0:
+		return aws.ToString(out.Versions[0].Key), aws.ToString(out.Versions[0].VersionId), true, nil
+	case len(out.DeleteMarkers) > 0:
+		return aws.ToString(out.DeleteMarkers[0].Key), aws.ToString(out.DeleteMarkers[0].VersionId), true, nil
+	case len(out.CommonPrefixes) > 0:
+		return aws.ToString(out.CommonPrefixes[0].Prefix), "", true, nil
+	}
+	return "", "", false, nil
+}
+
+// listObjectVersionsPage calls the ListObjectVersions API, decoding the keys of the response too if decodeKeys is set.
+func (c *s3cli) listObjectVersionsPage(ctx context.Context, bucket, prefix string, maxKeys int64, keyMarker, versionIdMarker *string, decodeKeys bool) (*s3.ListObjectVersionsOutput, error) {
+	input := s3.ListObjectVersionsInput{
+		Bucket:          aws.String(bucket),
+		MaxKeys:         aws.Int32(int32(maxKeys)),
+		KeyMarker:       keyMarker,
+		VersionIdMarker: versionIdMarker,
+		RequestPayer:    c.requestPayer(),
+		// keys are listed URL-encoded so that the ones with characters XML can't carry, e.g., control characters, survive the response.
+		EncodingType: types.EncodingTypeUrl,
+
+		ExpectedBucketOwner: c.expectedBucketOwner(),
+	}
+
+	if prefix != "" {
+		input.Prefix = aws.String(prefix)
+	}
+	if c.delimiter != "" {
+		input.Delimiter = aws.String(c.delimiter)
+	}
+
+	var attrs []any
+	if keyMarker != nil {
+		attrs = append(attrs, "keyMarker", *keyMarker)
+	}
+	if versionIdMarker != nil {
+		attrs = append(attrs, "versionIdMarker", *versionIdMarker)
+	}
+	c.logger.Info("Calling ListObjectVersions API", attrs...)
+
+	var out *s3.ListObjectVersionsOutput
+	err := c.withRetry(ctx, "ListObjectVersions", func() (err error) {
+		ctx, cancel := c.apiContext(ctx)
+		defer cancel()
+		defer c.metrics.observe("ListObjectVersions", time.Now())
+		out, err = c.s3API.ListObjectVersions(ctx, &input)
+		return err
+	})
+	if err != nil {
+		if berr := bucketError(err); berr != nil {
+			return nil, fmt.Errorf("ListObjectVersions API error: %w: %w", err, berr)
+		}
+		return nil, fmt.Errorf("ListObjectVersions API error: %w", err)
+	}
+	// S3-compatible services may ignore the encoding type, so the keys are only decoded if the response says they're encoded.
+	if out.EncodingType == types.EncodingTypeUrl {
+		if err := decodeListing(out, decodeKeys); err != nil {
+			return nil, fmt.Errorf("ListObjectVersions API error: %w", err)
+		}
+	}
+
+	// keys rolled up into common prefixes by the delimiter aren't listed, so they're kept.
+	if len(out.CommonPrefixes) > 0 {
+		prefixes := make([]string, len(out.CommonPrefixes))
+		for i, p := range out.CommonPrefixes {
+			prefixes[i] = aws.ToString(p.Prefix)
+		}
+		c.logger.Info("Skipped common prefixes", "commonPrefixes", prefixes)
+	}
+	return out, nil
+}
+
+// decodeListing decodes in place the common prefixes and the next key marker of a ListObjectVersions response
+// listed with EncodingType url, and the keys too if keys is set, so that the keys can be deleted and the marker passed back as is.
+func decodeListing(out *s3.ListObjectVersionsOutput, keys bool) error {
+	decode := func(s *string) error {
+		if s == nil {
+			return nil
+		}
+		decoded, err := url.QueryUnescape(*s)
+		if err != nil {
+			return fmt.Errorf("failed to decode key %q: %w", *s, err)
+		}
+		*s = decoded
+		return nil
+	}
+
+	if keys {
+		for _, v := range out.Versions {
+			if err := decode(v.Key); err != nil {
+				return err
+			}
+		}
+		for _, d := range out.DeleteMarkers {
+			if err := decode(d.Key); err != nil {
+				return err
+			}
+		}
+	}
+	for _, p := range out.CommonPrefixes {
+		if err := decode(p.Prefix); err != nil {
+			return err
+		}
+	}
+	return decode(out.NextKeyMarker)
+}
+
+func (c *s3cli) listMultipartUploads(ctx context.Context, bucket, prefix string, keyMarker, uploadIdMarker *string) (uploads []*upload, nextKeyMarker, nextUploadIdMarker *string, err error) {
+	input := s3.ListMultipartUploadsInput{
+		Bucket:         aws.String(bucket),
+		KeyMarker:      keyMarker,
+		UploadIdMarker: uploadIdMarker,
+		RequestPayer:   c.requestPayer(),
+
+		ExpectedBucketOwner: c.expectedBucketOwner(),
+	}
+	if prefix != "" {
+		input.Prefix = aws.String(prefix)
+	}
+
+	var out *s3.ListMultipartUploadsOutput
+	err = c.withRetry(ctx, "ListMultipartUploads", func() (err error) {
+		ctx, cancel := c.apiContext(ctx)
+		defer cancel()
+		defer c.metrics.observe("ListMultipartUploads", time.Now())
+		out, err = c.s3API.ListMultipartUploads(ctx, &input)
+		return err
+	})
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("ListMultipartUploads API error: %w", err)
+	}
+
+	uploads = make([]*upload, len(out.Uploads))
+	for i, u := range out.Uploads {
+		uploads[i] = &upload{
+			Key:       aws.ToString(u.Key),
+			UploadId:  aws.ToString(u.UploadId),
+			Initiated: aws.ToTime(u.Initiated),
+		}
+	}
+	if !aws.ToBool(out.IsTruncated) {
+		return uploads, nil, nil, nil
+	}
+	return uploads, out.NextKeyMarker, out.NextUploadIdMarker, nil
+}
+
+func (c *s3cli) abortMultipartUpload(ctx context.Context, bucket, key, uploadId string) error {
+	err := c.withRetry(ctx, "AbortMultipartUpload", func() error {
+		ctx, cancel := c.apiContext(ctx)
+		defer cancel()
+		defer c.metrics.observe("AbortMultipartUpload", time.Now())
+		_, err := c.s3API.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:       aws.String(bucket),
+			Key:          aws.String(key),
+			UploadId:     aws.String(uploadId),
+			RequestPayer: c.requestPayer(),
+
+			ExpectedBucketOwner: c.expectedBucketOwner(),
+		})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("AbortMultipartUpload API error: %w", err)
+	}
+	return nil
+}
+
+func (c *s3cli) deleteBucket(ctx context.Context, bucket string) error {
+	err := c.withRetry(ctx, "DeleteBucket", func() error {
+		ctx, cancel := c.apiContext(ctx)
+		defer cancel()
+		defer c.metrics.observe("DeleteBucket", time.Now())
+		_, err := c.s3API.DeleteBucket(ctx, &s3.DeleteBucketInput{Bucket: aws.String(bucket), ExpectedBucketOwner: c.expectedBucketOwner()})
+		return err
+	})
+	if err != nil {
+		// objects may have been written since the emptiness check.
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "BucketNotEmpty" {
+			return fmt.Errorf("DeleteBucket API error: %w: %w", err, ErrBucketNotEmpty)
+		}
+		return fmt.Errorf("DeleteBucket API error: %w", err)
+	}
+	return nil
+}
+
+func (c *s3cli) deleteObjects(ctx context.Context, bucket string, objects []*Object) (deleted int, err error) {
+	var failures []*deleteFailure
+	for i, batch := range chunk(objects, maxDeleteObjects) {
+		batchFailures, err := c.deleteObjectsBatch(ctx, bucket, batch)
+		if err != nil {
+			if len(failures) == 0 {
+				return deleted, err
+			}
+			// the failures of the previous calls are reported along with the objects left, so that the deleted objects
+			// aren't just the first ones anymore.
+			for _, o := range objects[i*maxDeleteObjects:] {
+				failures = append(failures, &deleteFailure{Object: o, Code: "RequestFailed", Message: err.Error()})
+			}
+			return deleted, fmt.Errorf("%w: %w", err, &deleteObjectsError{failures: failures})
+		}
+		deleted += len(batch) - len(batchFailures)
+
+		retried, batchFailures := c.retryFailures(ctx, bucket, batchFailures)
+		deleted += retried
+		failures = append(failures, batchFailures...)
+	}
+	if len(failures) > 0 {
+		err := &deleteObjectsError{failures: failures}
+		if c.mfa == "" {
+			for _, f := range failures {
+				if isMFARequired(f.Message) {
+					return deleted, fmt.Errorf("%w: %w", err, ErrMFARequired)
+				}
+			}
+		}
+		for _, f := range failures {
+			if isKMSError(f.Code, f.Message) {
+				return deleted, fmt.Errorf("%w: %w", err, ErrKMSPermission)
+			}
+		}
+		return deleted, err
+	}
+	return deleted, nil
+}
+
+// retryFailures deletes the objects that failed with a retryable error code, such as SlowDown, again with backoff up to maxRetries.
+// It returns the number of objects deleted by the retries and the failures left, the permanent ones and those still failing when giving up.
+// A failed retry call leaves its objects as failures with the error of the call, so that the other objects still count as deleted.
+func (c *s3cli) retryFailures(ctx context.Context, bucket string, failures []*deleteFailure) (deleted int, remaining []*deleteFailure) {
+	for attempt := 0; ; attempt++ {
+		var retryable []*deleteFailure
+		for _, f := range failures {
+			if isRetryableCode(f.Code) {
+				retryable = append(retryable, f)
+			} else {
+				remaining = append(remaining, f)
+			}
+		}
+		if len(retryable) == 0 {
+			return deleted, remaining
+		}
+
+		backoff := retryBackoff(attempt)
+		if deadline, ok := ctx.Deadline(); attempt >= c.maxRetries || (ok && time.Until(deadline) < backoff) {
+			return deleted, append(remaining, retryable...)
+		}
+		c.logger.Warn("Some objects failed to be deleted, retrying", "objects", len(retryable), "code", retryable[0].Code, "backoff", backoff, "attempt", attempt+1, "maxRetries", c.maxRetries)
+		if sleep(ctx, backoff) != nil {
+			return deleted, append(remaining, retryable...)
+		}
+
+		retry := make([]*Object, len(retryable))
+		for i, f := range retryable {
+			retry[i] = f.Object
+		}
+		var err error
+		if failures, err = c.deleteObjectsBatch(ctx, bucket, retry); err != nil {
+			for _, o := range retry {
+				remaining = append(remaining, &deleteFailure{Object: o, Code: "RetryFailed", Message: err.Error()})
+			}
+			return deleted, remaining
+		}
+		deleted += len(retry) - len(failures)
+	}
+}
+
+// isRetryableCode reports whether a per-object DeleteObjects error code is worth retrying.
+func isRetryableCode(code string) bool {
+	switch code {
+	case "SlowDown", "InternalError", "ServiceUnavailable":
+		return true
+	}
+	return false
+}
+
+// isNotFoundCode reports whether a per-object DeleteObjects error code means that the object is already gone.
+func isNotFoundCode(code string) bool {
+	return code == "NoSuchKey" || code == "NoSuchVersion"
+}
+
+// requestPayer returns the RequestPayer parameter, which is left empty unless requesterPays is set.
+func (c *s3cli) requestPayer() types.RequestPayer {
+	if c.requesterPays {
+		return types.RequestPayerRequester
+	}
+	return ""
+}
+
+// expectedBucketOwner returns the ExpectedBucketOwner parameter, which is nil unless bucketOwner is set.
+func (c *s3cli) expectedBucketOwner() *string {
+	if c.bucketOwner == "" {
+		return nil
+	}
+	return aws.String(c.bucketOwner)
+}
+
+// isKMSError reports whether a per-object DeleteObjects error is about the KMS key of the object, such as KMS.AccessDeniedException.
+func isKMSError(code, message string) bool {
+	return strings.HasPrefix(code, "KMS.") || strings.Contains(strings.ToLower(message), "kms")
+}
+
+// bucketError returns ErrBucketNotFound or ErrAccessDenied if err has the matching S3 error code, nil otherwise.
+func bucketError(err error) error {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return nil
+	}
+	switch apiErr.ErrorCode() {
+	case "NoSuchBucket":
+		return ErrBucketNotFound
+	case "AccessDenied", "AllAccessDisabled":
+		return ErrAccessDenied
+	}
+	return nil
+}
+
+// hasErrorCode reports whether err is an S3 error with the given code.
+func hasErrorCode(err error, code string) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == code
+}
+
+// isMFARequired reports whether an error message from S3 indicates that the request needs MFA authentication.
+func isMFARequired(message string) bool {
+	return strings.Contains(strings.ToLower(message), "mfa")
+}
+
+func (c *s3cli) deleteObjectsBatch(ctx context.Context, bucket string, objects []*Object) ([]*deleteFailure, error) {
+	ids := make([]types.ObjectIdentifier, len(objects))
+	for i, o := range objects {
+		ids[i] = types.ObjectIdentifier{Key: aws.String(o.Key)}
+		if !c.addDeleteMarkers {
+			ids[i].VersionId = aws.String(o.VersionId)
+		}
+	}
+	input := s3.DeleteObjectsInput{
+		Bucket: aws.String(bucket),
+		Delete: &types.Delete{
+			Objects: ids,
+			// the deleted objects are counted from the errors, so the quiet mode saves listing up to 1000 of them back in each response.
+			// errors are still reported.
+			Quiet: aws.Bool(true),
+		},
+		RequestPayer: c.requestPayer(),
+
+		ExpectedBucketOwner: c.expectedBucketOwner(),
+	}
+	if c.bypassGovernance {
+		input.BypassGovernanceRetention = aws.Bool(true)
+	}
+	if c.mfa != "" {
+		input.MFA = aws.String(c.mfa)
+	}
+
+	c.logger.Info("Calling DeleteObjects API", "objects", len(objects))
+	var out *s3.DeleteObjectsOutput
+	err := c.withRetry(ctx, "DeleteObjects", func() (err error) {
+		if c.deleteLimiter != nil {
+			if err := c.deleteLimiter.Wait(ctx); err != nil {
+				return err
+			}
+		}
+		// the wait for the limiter doesn't count against the API timeout.
+		ctx, cancel := c.apiContext(ctx)
+		defer cancel()
+		defer c.metrics.observe("DeleteObjects", time.Now())
+		out, err = c.s3API.DeleteObjects(ctx, &input)
+		return err
+	})
+	if err != nil {
+		var apiErr smithy.APIError
+		if c.mfa == "" && errors.As(err, &apiErr) && isMFARequired(apiErr.ErrorMessage()) {
+			return nil, fmt.Errorf("DeleteObjects API error: %w: %w", err, ErrMFARequired)
+		}
+		if berr := bucketError(err); berr != nil {
+			return nil, fmt.Errorf("DeleteObjects API error: %w: %w", err, berr)
+		}
+		return nil, fmt.Errorf("DeleteObjects API error: %w", err)
+	}
+
+	if len(out.Errors) == 0 {
+		return nil, nil
+	}
+	failures := make([]*deleteFailure, 0, len(out.Errors))
+	var notFound int
+	for _, e := range out.Errors {
+		if c.ignoreNotFound && isNotFoundCode(aws.ToString(e.Code)) {
+			notFound++
+			continue
+		}
+		failures = append(failures, &deleteFailure{
+			Object: &Object{
+				Key:       aws.ToString(e.Key),
+				VersionId: aws.ToString(e.VersionId),
+			},
+			Code:    aws.ToString(e.Code),
+			Message: aws.ToString(e.Message),
+		})
+	}
+	if notFound > 0 {
+		c.logger.Info("Ignored objects already deleted", "objects", notFound)
+	}
+	// without version IDs in the request, the failures are matched back to the listed current versions, one per key, by key.
+	if c.addDeleteMarkers {
+		versionIds := make(map[string]string, len(objects))
+		for _, o := range objects {
+			versionIds[o.Key] = o.VersionId
+		}
+		for _, f := range failures {
+			f.VersionId = versionIds[f.Key]
+		}
+	}
+	return failures, nil
+}
+
+// apiContext returns the context of a single API call, bounded by apiTimeout when set.
+func (c *s3cli) apiContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.apiTimeout > 0 {
+		return context.WithTimeout(ctx, c.apiTimeout)
+	}
+	return ctx, func() {}
+}
+
+// withRetry calls fn until it succeeds, fails with a non-retryable error, or maxRetries is exhausted.
+// It gives up early rather than sleeping past the context deadline, and a cancellation during the backoff
+// returns the context error, wrapping the last error of fn, without waiting for the backoff to elapse.
+func (c *s3cli) withRetry(ctx context.Context, api string, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		// a call timing out on the API timeout rather than the deadline of ctx is retried, as a stuck connection would be.
+		timedOut := c.apiTimeout > 0 && errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil
+		if err == nil || attempt >= c.maxRetries || (!isRetryable(err) && !timedOut) {
+			return err
+		}
+
+		backoff := retryBackoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < backoff {
+			return err
+		}
+		c.logger.Warn("API call failed, retrying", "api", api, "backoff", backoff, "attempt", attempt+1, "maxRetries", c.maxRetries, "error", err)
+
+		if serr := sleep(ctx, backoff); serr != nil {
+			return fmt.Errorf("%w while waiting to retry %s: %w", serr, api, err)
+		}
+	}
+}
+
+// sleep waits for d, returning the error of ctx early if it's done first.
+// Unlike time.After, the timer is released as soon as ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// retryBackoff returns an exponential backoff with full jitter for the given attempt.
+func retryBackoff(attempt int) time.Duration {
+	backoff := maxRetryBackoff
+	if attempt < 16 {
+		backoff = min(baseRetryBackoff<<attempt, maxRetryBackoff)
+	}
+	return time.Duration(rand.Int63n(int64(backoff)))
+}
+
+// isRetryable reports whether err is a throttling or server-side error worth retrying.
+// Errors such as AccessDenied or NoSuchBucket won't go away by retrying, so they aren't.
+func isRetryable(err error) bool {
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &respErr) {
+		switch respErr.HTTPStatusCode() {
+		case http.StatusInternalServerError, http.StatusServiceUnavailable:
+			return true
+		}
+	}
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.ErrorCode() {
+		case "SlowDown", "Throttling", "ThrottlingException", "RequestLimitExceeded", "InternalError", "ServiceUnavailable":
+			return true
+		}
+	}
+
+	return false
+}
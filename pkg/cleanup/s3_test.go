@@ -0,0 +1,440 @@
+package cleanup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// fakeS3API is an S3API whose calls go to the functions set on it; the unset ones panic.
+type fakeS3API struct {
+	S3API
+
+	listObjectVersions func(*s3.ListObjectVersionsInput) (*s3.ListObjectVersionsOutput, error)
+	deleteObjects      func(*s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error)
+	getObject          func(context.Context, *s3.GetObjectInput) (*s3.GetObjectOutput, error)
+
+	mu          sync.Mutex
+	deleteCalls []int
+}
+
+func (f *fakeS3API) ListObjectVersions(ctx context.Context, params *s3.ListObjectVersionsInput, optFns ...func(*s3.Options)) (*s3.ListObjectVersionsOutput, error) {
+	return f.listObjectVersions(params)
+}
+
+func (f *fakeS3API) DeleteObjects(ctx context.Context, params *s3.DeleteObjectsInput, optFns ...func(*s3.Options)) (*s3.DeleteObjectsOutput, error) {
+	f.mu.Lock()
+	f.deleteCalls = append(f.deleteCalls, len(params.Delete.Objects))
+	f.mu.Unlock()
+	if f.deleteObjects == nil {
+		return &s3.DeleteObjectsOutput{}, nil
+	}
+	return f.deleteObjects(params)
+}
+
+func (f *fakeS3API) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	return f.getObject(ctx, params)
+}
+
+func (f *fakeS3API) HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (f *fakeS3API) GetBucketVersioning(ctx context.Context, params *s3.GetBucketVersioningInput, optFns ...func(*s3.Options)) (*s3.GetBucketVersioningOutput, error) {
+	return &s3.GetBucketVersioningOutput{Status: types.BucketVersioningStatusEnabled}, nil
+}
+
+// newTestS3cli creates the s3cli of cfg on top of the fake API, logging nothing.
+func newTestS3cli(api S3API, cfg Config) *s3cli {
+	return newS3cli(api, cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func TestDeleteObjectsChunks(t *testing.T) {
+	objects := testObjects("k", 2500, 0)
+
+	t.Run("s3cli", func(t *testing.T) {
+		api := &fakeS3API{}
+		deleted, err := newTestS3cli(api, Config{}).deleteObjects(context.Background(), "test", objects)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deleted != 2500 {
+			t.Errorf("deleted = %d, want 2500", deleted)
+		}
+		if want := []int{1000, 1000, 500}; !reflect.DeepEqual(api.deleteCalls, want) {
+			t.Errorf("DeleteObjects calls = %v, want %v", api.deleteCalls, want)
+		}
+	})
+
+	t.Run("cleaner", func(t *testing.T) {
+		f := &fakeS3Client{pages: []fakePage{{versions: objects}}}
+		r, err := newTestCleaner(t, f, Config{}).Cleanup(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.DeletedVersions != 2500 {
+			t.Errorf("DeletedVersions = %d, want 2500", r.DeletedVersions)
+		}
+		var sizes []int
+		for _, keys := range f.deleteCalls {
+			sizes = append(sizes, len(keys))
+		}
+		if want := []int{1000, 1000, 500}; !reflect.DeepEqual(sizes, want) {
+			t.Errorf("DeleteObjects calls = %v, want %v", sizes, want)
+		}
+	})
+}
+
+// encodedKeys maps keys with characters that need URL-encoding to their encoding in ListObjectVersions responses with EncodingType url.
+var encodedKeys = map[string]string{
+	"with space.txt":     "with+space.txt",
+	"a+b=c.txt":          "a%2Bb%3Dc.txt",
+	"日本語/ファイル.txt":       "%E6%97%A5%E6%9C%AC%E8%AA%9E/%E3%83%95%E3%82%A1%E3%82%A4%E3%83%AB.txt",
+	"line\nbreak":        "line%0Abreak",
+	"100% done/é +x.txt": "100%25+done/%C3%A9+%2Bx.txt",
+}
+
+func TestListObjectVersionsDecodesKeys(t *testing.T) {
+	for key, encoded := range encodedKeys {
+		t.Run(key, func(t *testing.T) {
+			api := &fakeS3API{listObjectVersions: func(in *s3.ListObjectVersionsInput) (*s3.ListObjectVersionsOutput, error) {
+				if in.EncodingType != types.EncodingTypeUrl {
+					t.Errorf("EncodingType = %q, want %q", in.EncodingType, types.EncodingTypeUrl)
+				}
+				return &s3.ListObjectVersionsOutput{
+					EncodingType:        types.EncodingTypeUrl,
+					Versions:            []types.ObjectVersion{{Key: aws.String(encoded), VersionId: aws.String("v1")}},
+					DeleteMarkers:       []types.DeleteMarkerEntry{{Key: aws.String(encoded), VersionId: aws.String("v2")}},
+					CommonPrefixes:      []types.CommonPrefix{{Prefix: aws.String(encoded + "/")}},
+					NextKeyMarker:       aws.String(encoded),
+					NextVersionIdMarker: aws.String("v2"),
+				}, nil
+			}}
+			c := newTestS3cli(api, Config{})
+
+			versions, deleteMarkers, nextKeyMarker, _, err := c.listObjectVersions(context.Background(), "test", "", 1000, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(versions) != 1 || versions[0].Key != key {
+				t.Errorf("versions = %+v, want key %q", versions, key)
+			}
+			if len(deleteMarkers) != 1 || deleteMarkers[0].Key != key {
+				t.Errorf("delete markers = %+v, want key %q", deleteMarkers, key)
+			}
+			if aws.ToString(nextKeyMarker) != key {
+				t.Errorf("next key marker = %q, want %q", aws.ToString(nextKeyMarker), key)
+			}
+
+			// counting doesn't decode the keys, but the marker it passes back must be decoded all the same.
+			counts, nextKeyMarker, _, err := c.countObjectVersions(context.Background(), "test", "", 1000, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if counts != (objectCounts{versions: 1, deleteMarkers: 1}) {
+				t.Errorf("counts = %+v, want 1 version and 1 delete marker", counts)
+			}
+			if aws.ToString(nextKeyMarker) != key {
+				t.Errorf("counted next key marker = %q, want %q", aws.ToString(nextKeyMarker), key)
+			}
+		})
+	}
+}
+
+func TestListObjectVersionsKeepsUnencodedKeys(t *testing.T) {
+	// S3-compatible services may ignore the encoding type, in which case a "+" is part of the key.
+	api := &fakeS3API{listObjectVersions: func(in *s3.ListObjectVersionsInput) (*s3.ListObjectVersionsOutput, error) {
+		return &s3.ListObjectVersionsOutput{Versions: []types.ObjectVersion{{Key: aws.String("a+b%20c"), VersionId: aws.String("v1")}}}, nil
+	}}
+	versions, _, _, _, err := newTestS3cli(api, Config{}).listObjectVersions(context.Background(), "test", "", 1000, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || versions[0].Key != "a+b%20c" {
+		t.Errorf("versions = %+v, want key %q", versions, "a+b%20c")
+	}
+}
+
+func TestListObjectVersionsInvalidEncoding(t *testing.T) {
+	api := &fakeS3API{listObjectVersions: func(in *s3.ListObjectVersionsInput) (*s3.ListObjectVersionsOutput, error) {
+		return &s3.ListObjectVersionsOutput{
+			EncodingType: types.EncodingTypeUrl,
+			Versions:     []types.ObjectVersion{{Key: aws.String("bad%zz"), VersionId: aws.String("v1")}},
+		}, nil
+	}}
+	if _, _, _, _, err := newTestS3cli(api, Config{}).listObjectVersions(context.Background(), "test", "", 1000, nil, nil); err == nil {
+		t.Error("listObjectVersions() succeeded with an invalid encoding")
+	}
+}
+
+func TestSleepCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := sleep(ctx, time.Hour)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("sleep() error = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("sleep() returned after %v, want promptly after the cancellation", elapsed)
+	}
+}
+
+func TestWithRetryCanceledDuringBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := newTestS3cli(&fakeS3API{}, Config{MaxRetries: 100})
+	throttled := &smithy.GenericAPIError{Code: "SlowDown"}
+
+	var attempts int
+	start := time.Now()
+	err := c.withRetry(ctx, "DeleteObjects", func() error {
+		attempts++
+		if attempts == 1 {
+			// the backoffs are jittered, so the cancellation may land in the first one or in a later one.
+			time.AfterFunc(20*time.Millisecond, cancel)
+		}
+		return throttled
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("withRetry() error = %v, want %v", err, context.Canceled)
+	}
+	if !errors.Is(err, throttled) {
+		t.Errorf("withRetry() error = %v, want it to wrap the last API error", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("withRetry() returned after %v, want promptly after the cancellation", elapsed)
+	}
+	if attempts >= 100 {
+		t.Errorf("withRetry() made %d attempts, want it to stop retrying once canceled", attempts)
+	}
+}
+
+// newBenchmarkCleaner creates a Cleaner over a fake S3API serving 100 pages of 750 versions and 250 delete markers,
+// so that the listing goes through the response mapping of s3cli.
+func newBenchmarkCleaner(b *testing.B) *Cleaner {
+	pages := make([]*s3.ListObjectVersionsOutput, 100)
+	for p := range pages {
+		out := &s3.ListObjectVersionsOutput{}
+		for i := 0; i < 1000; i++ {
+			key := aws.String(fmt.Sprintf("dir/key-%d-%d", p, i))
+			if i%4 == 0 {
+				out.DeleteMarkers = append(out.DeleteMarkers, types.DeleteMarkerEntry{Key: key, VersionId: aws.String("v")})
+			} else {
+				out.Versions = append(out.Versions, types.ObjectVersion{Key: key, VersionId: aws.String("v"), Size: aws.Int64(10)})
+			}
+		}
+		if p+1 < len(pages) {
+			out.NextKeyMarker = aws.String(strconv.Itoa(p + 1))
+			out.NextVersionIdMarker = aws.String("next")
+		}
+		pages[p] = out
+	}
+	api := &fakeS3API{listObjectVersions: func(in *s3.ListObjectVersionsInput) (*s3.ListObjectVersionsOutput, error) {
+		p := 0
+		if in.KeyMarker != nil {
+			p, _ = strconv.Atoi(*in.KeyMarker)
+		}
+		return pages[p], nil
+	}}
+
+	c, err := New(api, Config{Bucket: "test", Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return c
+}
+
+// BenchmarkCount compares counting the pages without allocating their objects, as Count does without filters,
+// with listing them, as Count does with filters.
+func BenchmarkCount(b *testing.B) {
+	b.Run("count", func(b *testing.B) {
+		c := newBenchmarkCleaner(b)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			r, err := c.Count(context.Background())
+			if err != nil {
+				b.Fatal(err)
+			}
+			if r.DeletedVersions != 75000 || r.DeletedDeleteMarkers != 25000 {
+				b.Fatalf("Count() = %+v, want 75000 versions and 25000 delete markers", *r)
+			}
+		}
+	})
+	b.Run("list", func(b *testing.B) {
+		c := newBenchmarkCleaner(b)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := c.List(context.Background(), func(*ManifestEntry) error { return nil }); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// ctxReader fails its reads once its context is done, like the body of an HTTP response.
+type ctxReader struct {
+	ctx context.Context
+	io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.Reader.Read(p)
+}
+
+func TestGetObject(t *testing.T) {
+	calls := 0
+	api := &fakeS3API{getObject: func(ctx context.Context, in *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+		calls++
+		if calls == 1 {
+			return nil, &smithy.GenericAPIError{Code: "SlowDown"}
+		}
+		if in.RequestPayer != types.RequestPayerRequester || aws.ToString(in.ExpectedBucketOwner) != "123456789012" {
+			t.Errorf("GetObject input = %+v, want the request payer and the expected bucket owner", in)
+		}
+		return &s3.GetObjectOutput{Body: io.NopCloser(ctxReader{ctx, strings.NewReader("body")})}, nil
+	}}
+	c := newTestS3cli(api, Config{MaxRetries: 1, APITimeout: 10 * time.Millisecond, RequesterPays: true, ExpectedBucketOwner: "123456789012"})
+
+	body, err := c.getObject(context.Background(), "test", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	if calls != 2 {
+		t.Errorf("GetObject calls = %d, want 2", calls)
+	}
+	// the body is still readable after the API timeout, which only bounds getting the response.
+	time.Sleep(20 * time.Millisecond)
+	b, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "body" {
+		t.Errorf("body = %q, want %q", b, "body")
+	}
+}
+
+func TestFirstObjectVersion(t *testing.T) {
+	tests := []struct {
+		name      string
+		out       s3.ListObjectVersionsOutput
+		wantKey   string
+		wantFound bool
+	}{
+		{name: "empty", out: s3.ListObjectVersionsOutput{}},
+		{name: "version", out: s3.ListObjectVersionsOutput{Versions: []types.ObjectVersion{{Key: aws.String("a/b"), VersionId: aws.String("v1")}}}, wantKey: "a/b", wantFound: true},
+		{name: "delete marker", out: s3.ListObjectVersionsOutput{DeleteMarkers: []types.DeleteMarkerEntry{{Key: aws.String("a/b"), VersionId: aws.String("v1")}}}, wantKey: "a/b", wantFound: true},
+		{name: "common prefix", out: s3.ListObjectVersionsOutput{CommonPrefixes: []types.CommonPrefix{{Prefix: aws.String("a/")}}}, wantKey: "a/", wantFound: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &fakeS3API{listObjectVersions: func(in *s3.ListObjectVersionsInput) (*s3.ListObjectVersionsOutput, error) {
+				// the prefix and the delimiter of the Cleaner would hide the keys outside of the listed "directory".
+				if in.Prefix != nil || in.Delimiter != nil || aws.ToInt32(in.MaxKeys) != 1 {
+					t.Errorf("ListObjectVersions input = %+v, want no prefix, no delimiter, and MaxKeys 1", in)
+				}
+				return &tt.out, nil
+			}}
+			c := newTestS3cli(api, Config{Prefix: "x/", Delimiter: "/"})
+
+			key, _, found, err := c.firstObjectVersion(context.Background(), "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key != tt.wantKey || found != tt.wantFound {
+				t.Errorf("firstObjectVersion() = %q, %v, want %q, %v", key, found, tt.wantKey, tt.wantFound)
+			}
+		})
+	}
+}
+
+func TestDeleteObjectsKeepsFailuresOnError(t *testing.T) {
+	objects := testObjects("k", 2500, 0)
+	errNetwork := errors.New("connection reset")
+	api := &fakeS3API{}
+	api.deleteObjects = func(in *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+		// the first call fails on an object, and the second one as a whole.
+		if len(api.deleteCalls) == 1 {
+			return &s3.DeleteObjectsOutput{Errors: []types.Error{{Key: aws.String("k1"), VersionId: aws.String("v1"), Code: aws.String("AccessDenied")}}}, nil
+		}
+		return nil, errNetwork
+	}
+
+	deleted, err := newTestS3cli(api, Config{}).deleteObjects(context.Background(), "test", objects)
+	if !errors.Is(err, errNetwork) {
+		t.Fatalf("deleteObjects() error = %v, want %v", err, errNetwork)
+	}
+	if deleted != 999 {
+		t.Errorf("deleted = %d, want 999", deleted)
+	}
+	if want := []int{1000, 1000}; !reflect.DeepEqual(api.deleteCalls, want) {
+		t.Errorf("DeleteObjects calls = %v, want %v", api.deleteCalls, want)
+	}
+
+	failed := failedObjects(objects, deleted, err)
+	if len(failed) != 1501 || failed[0].Key != "k1" || failed[1].Key != "k1001" {
+		t.Errorf("failed objects = %d starting with %v, want 1501 starting with k1 and k1001", len(failed), failed[:min(2, len(failed))])
+	}
+	if n := len(deletedObjects(objects, deleted, err)); n != 999 {
+		t.Errorf("deleted objects = %d, want 999", n)
+	}
+}
+
+func TestDeleteObjectsIgnoreNotFound(t *testing.T) {
+	objects := testObjects("k", 5, 0)
+	api := &fakeS3API{}
+	api.deleteObjects = func(in *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+		return &s3.DeleteObjectsOutput{Errors: []types.Error{
+			{Key: aws.String("k1"), VersionId: aws.String("v1"), Code: aws.String("NoSuchVersion")},
+			{Key: aws.String("k2"), VersionId: aws.String("v2"), Code: aws.String("NoSuchKey")},
+			{Key: aws.String("k3"), VersionId: aws.String("v3"), Code: aws.String("AccessDenied")},
+		}}, nil
+	}
+
+	for _, tt := range []struct {
+		name           string
+		ignoreNotFound bool
+		wantDeleted    int
+		wantFailed     []string
+	}{
+		{name: "reported", wantDeleted: 2, wantFailed: []string{"k1", "k2", "k3"}},
+		// the versions already gone count as deleted, while other failures are still reported.
+		{name: "ignored", ignoreNotFound: true, wantDeleted: 4, wantFailed: []string{"k3"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			deleted, err := newTestS3cli(api, Config{IgnoreNotFound: tt.ignoreNotFound}).deleteObjects(context.Background(), "test", objects)
+			if !errors.Is(err, ErrObjectsNotDeleted) {
+				t.Fatalf("deleteObjects() error = %v, want %v", err, ErrObjectsNotDeleted)
+			}
+			if deleted != tt.wantDeleted {
+				t.Errorf("deleted = %d, want %d", deleted, tt.wantDeleted)
+			}
+			var failed []string
+			for _, o := range failedObjects(objects, deleted, err) {
+				failed = append(failed, o.Key)
+			}
+			if !reflect.DeepEqual(failed, tt.wantFailed) {
+				t.Errorf("failed objects = %v, want %v", failed, tt.wantFailed)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package cleanup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// TagFilter selects the versions to delete by one of their tags.
+type TagFilter struct {
+	Key   string
+	Value string
+	// Negate selects the versions that don't have the tag with the value, including untagged ones.
+	Negate bool
+}
+
+// ParseTagFilter parses a "key=value" or "key!=value" tag filter.
+func ParseTagFilter(s string) (*TagFilter, error) {
+	if key, value, ok := strings.Cut(s, "!="); ok && key != "" {
+		return &TagFilter{Key: key, Value: value, Negate: true}, nil
+	}
+	if key, value, ok := strings.Cut(s, "="); ok && key != "" {
+		return &TagFilter{Key: key, Value: value}, nil
+	}
+	return nil, fmt.Errorf("tag filter must be key=value or key!=value, got %q", s)
+}
+
+func (f *TagFilter) String() string {
+	if f.Negate {
+		return f.Key + "!=" + f.Value
+	}
+	return f.Key + "=" + f.Value
+}
+
+// Match reports whether a version with the given tags is to be deleted.
+func (f *TagFilter) Match(tags map[string]string) bool {
+	value, ok := tags[f.Key]
+	return (ok && value == f.Value) != f.Negate
+}
+
+// filterTagged returns the versions whose tags match the tag filter, calling GetObjectTagging for each of them.
+// Delete markers have no tags, so they're never passed here.
+func (c *Cleaner) filterTagged(ctx context.Context, versions []*Object) ([]*Object, error) {
+	if c.tagFilter == nil || len(versions) == 0 {
+		return versions, nil
+	}
+
+	var filtered []*Object
+	for _, v := range versions {
+		tags, err := c.getObjectTagging(ctx, c.bucket, v.Key, v.VersionId)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the tags of key %q version %q: %w", v.Key, v.VersionId, err)
+		}
+		if c.tagFilter.Match(tags) {
+			filtered = append(filtered, v)
+		}
+	}
+	if skipped := len(versions) - len(filtered); skipped > 0 {
+		c.logger.Info("Skipped versions not matching the tag filter", "skipped", skipped, "tagFilter", c.tagFilter.String())
+	}
+	return filtered, nil
+}
@@ -0,0 +1,53 @@
+package cleanup
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// noSpan is returned by startSpan without a tracer, so that the callers don't need to check for one.
+var noSpan trace.Span = noop.Span{}
+
+// startSpan starts a span as a child of the span in ctx, if any. Without Config.Tracer, it returns ctx as is.
+// attrs is a function so that the attributes aren't even built without a tracer.
+func (c *Cleaner) startSpan(ctx context.Context, name string, attrs func() []attribute.KeyValue) (context.Context, trace.Span) {
+	if c.tracer == nil {
+		return ctx, noSpan
+	}
+	a := []attribute.KeyValue{attribute.String("bucket", c.bucket)}
+	if attrs != nil {
+		a = append(a, attrs()...)
+	}
+	return c.tracer.Start(ctx, name, trace.WithAttributes(a...))
+}
+
+// endSpan records err, if any, on the span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// endResultSpan records the counts of r and err, if any, on the span of a cleanup and ends it.
+func endResultSpan(span trace.Span, r *Result, err error) {
+	if r != nil && span.IsRecording() {
+		span.SetAttributes(
+			attribute.Int("deletedVersions", r.DeletedVersions),
+			attribute.Int("deletedDeleteMarkers", r.DeletedDeleteMarkers),
+			attribute.Int64("freedBytes", r.FreedBytes),
+			attribute.Int("failedObjects", r.FailedObjects),
+		)
+	}
+	endSpan(span, err)
+}
+
+// spanAttributes returns the attributes of the span of a cleanup.
+func (c *Cleaner) spanAttributes() []attribute.KeyValue {
+	return []attribute.KeyValue{attribute.String("prefix", c.prefix), attribute.Bool("dryRun", c.dryRun)}
+}